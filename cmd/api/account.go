@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+// exportCurrentUserHandler returns everything stored about the user, as a JSON download.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	identities, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	totpEnabled, err := app.totpEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies, err := app.models.Movies.GetAllCreatedBy(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	events, err := app.models.Audit.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"exported_at":           time.Now(),
+		"user":                  user,
+		"roles":                 roles,
+		"permissions":           permissions,
+		"effective_permissions": effective,
+		"sessions":              sessions,
+		"api_keys":              apiKeys,
+		"identities":            identities,
+		"totp_enabled":          totpEnabled,
+		"movies":                movies,
+		"audit_events":          events,
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.json"`, user.ID))
+	headers.Set("Cache-Control", "no-store")
+
+	if err := app.writeJSON(w, http.StatusOK, env, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler schedules the user's account for deletion once the grace period
+// is over. They are logged out everywhere straight away, and emailed a token that cancels
+// the deletion.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		// Users created by logging in through an identity provider were given a password
+		// nobody knows, so they have to set one before they can confirm with it.
+		identities, err := app.models.Identities.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if len(identities) > 0 {
+			v.AddError("password", "is incorrect, if you log in through an identity provider you need to set a password with a password reset first")
+		} else {
+			v.AddError("password", "is incorrect")
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	before := *user
+	scheduledAt := time.Now().Add(app.config.deletion.gracePeriod)
+	user.DeletionScheduledAt = &scheduledAt
+
+	var token *data.Token
+	denied := denials{}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		if err := app.endAllSessions(r, m, user.ID, nil, denied); err != nil {
+			return err
+		}
+
+		var err error
+		token, err = m.Tokens.New(user.ID, app.config.deletion.gracePeriod, data.ScopeDeletionCancel)
+		if err != nil {
+			return err
+		}
+
+		if err := app.audit(r, m, data.AuditEvent{Action: "user.deletion_schedule", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user); err != nil {
+			return err
+		}
+
+		return app.auditTokenIssued(r, m, user, token)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applyDenials(denied)
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"cancelToken": token.Plaintext,
+			"name":        user.Name,
+			"deletionAt":  scheduledAt.Format(time.RFC1123),
+		}
+
+		if err := app.mailer.Send(user.Email, "user_deletion_scheduled.tmpl", data); err != nil {
+			app.logger.Error("failed to send email", "error", err)
+		}
+	})
+
+	env := envelope{"message": "your account will be deleted, follow the instructions emailed to you to cancel", "user": user}
+
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelUserDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeDeletionCancel, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired deletion cancellation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	before := *user
+	user.DeletionScheduledAt = nil
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeDeletionCancel); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.deletion_cancel", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runAccountDeletion periodically deletes the accounts whose grace period is over.
+func (app *application) runAccountDeletion(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		users, err := app.models.Users.GetAllDueForDeletion()
+		if err != nil {
+			app.logger.Error("failed to find accounts due for deletion", "error", err)
+			continue
+		}
+
+		for _, user := range users {
+			if err := app.deleteUser(user); err != nil {
+				app.logger.Error("failed to delete account", "error", err, "user_id", user.ID)
+			}
+		}
+	}
+}
+
+// deleteUser deletes the user and everything that belongs to them. Movies they added are
+// kept without an owner, and the audit log keeps what happened to the account but not the
+// personal data it recorded.
+func (app *application) deleteUser(user *data.User) error {
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Delete(user); err != nil {
+			return err
+		}
+
+		if err := m.LoginFailures.DeleteForEmail(user.Email); err != nil {
+			return err
+		}
+
+		if err := m.Audit.AnonymiseForUser(user.ID); err != nil {
+			return err
+		}
+
+		return m.Audit.Insert(&data.AuditEvent{Action: "user.delete", TargetType: data.AuditTargetUser, TargetID: user.ID})
+	})
+
+	// The user cancelled the deletion, or another instance got there first.
+	if errors.Is(err, data.ErrEditConflict) {
+		return nil
+	}
+
+	return err
+}
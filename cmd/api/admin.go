@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{
+		"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at",
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"user":                  user,
+		"roles":                 roles,
+		"permissions":           permissions,
+		"effective_permissions": effective,
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	before := *user
+
+	if input.Activated != nil {
+		user.Activated = *input.Activated
+	}
+
+	denied := denials{}
+
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		if user.Activated == before.Activated {
+			return nil
+		}
+
+		action := "user.activate"
+		if !user.Activated {
+			action = "user.deactivate"
+
+			// Signed tokens carry the activation status, so a deactivated user has to be
+			// logged out for it to take effect straight away.
+			if err := app.endAllSessions(r, m, user.ID, nil, denied); err != nil {
+				return err
+			}
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: action, TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) lockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Until time.Time `json:"until"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Until.After(time.Now()), "until", "must be in the future"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	before := *user
+	user.LockedUntil = &input.Until
+
+	denied := denials{}
+
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.SetLockedUntil(user.ID, user.LockedUntil); err != nil {
+			return err
+		}
+
+		// A lock only stops new logins, so end the sessions the user already has.
+		if err := app.endAllSessions(r, m, user.ID, nil, denied); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "user.lock", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	before := *user
+	user.LockedUntil = nil
+
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.SetLockedUntil(user.ID, nil); err != nil {
+			return err
+		}
+
+		// Otherwise the next failed login could lock the user out again straight away.
+		if err := m.LoginFailures.DeleteForEmail(user.Email); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "user.unlock", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserPermissions(w, r, "user.permissions.grant", func(m data.Models, userID int64, codes ...string) error {
+		return m.Permissions.AddForUser(userID, codes...)
+	})
+}
+
+func (app *application) replaceUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserPermissions(w, r, "user.permissions.replace", func(m data.Models, userID int64, codes ...string) error {
+		return m.Permissions.ReplaceForUser(userID, codes...)
+	})
+}
+
+// setUserPermissions handles both granting and replacing a user's direct permissions, which
+// only differ in the model method that stores them. It responds with the resulting set.
+func (app *application) setUserPermissions(w http.ResponseWriter, r *http.Request, action string, store func(m data.Models, userID int64, codes ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(validator.PermittedValue(code, codes...), "permissions", "must only contain known permissions")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var permissions data.Permissions
+
+	err = app.models.Transaction(func(m data.Models) error {
+		before, err := m.Permissions.GetDirectForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := store(m, user.ID, input.Permissions...); err != nil {
+			return err
+		}
+
+		permissions, err = m.Permissions.GetDirectForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: action, TargetType: data.AuditTargetUser, TargetID: user.ID}, envelope{"permissions": before}, envelope{"permissions": permissions})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Permissions.RemoveForUser(user.ID, code); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "user.permissions.revoke", TargetType: data.AuditTargetUser, TargetID: user.ID}, envelope{"permission": code}, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "permission successfully revoked"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) logoutUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	denied := denials{}
+
+	err := app.models.Transaction(func(m data.Models) error {
+		return app.endAllSessions(r, m, user.ID, nil, denied)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions successfully ended"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserParam looks up the user named by the id parameter, sending the response itself if
+// that fails.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyLockedUser(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.routes()
+
+	user := newTestUser(t, app, "alice@example.com", "movies:read")
+	authorization := newTestAPIKey(t, app, user, "movies:read")
+
+	if status := do(t, routes, http.MethodGet, "/v1/movies", authorization, nil, nil); status != http.StatusOK {
+		t.Fatalf("before lock: got status %d, want %d", status, http.StatusOK)
+	}
+
+	until := time.Now().Add(time.Hour)
+	if err := app.models.Users.SetLockedUntil(user.ID, &until); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := do(t, routes, http.MethodGet, "/v1/movies", authorization, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("locked: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	if err := app.models.Users.SetLockedUntil(user.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := do(t, routes, http.MethodGet, "/v1/movies", authorization, nil, nil); status != http.StatusOK {
+		t.Errorf("unlocked: got status %d, want %d", status, http.StatusOK)
+	}
+}
+
+// Keys can only be used for what they were granted, never to manage the account they belong
+// to, whatever their permissions.
+func TestAPIKeyAccountRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.routes()
+
+	user := newTestUser(t, app, "alice@example.com", "movies:read")
+	authorization := newTestAPIKey(t, app, user, "movies:read")
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{method: http.MethodPatch, path: "/v1/users/me"},
+		{method: http.MethodDelete, path: "/v1/users/me"},
+		{method: http.MethodGet, path: "/v1/users/me/export"},
+		{method: http.MethodPost, path: "/v1/users/me/email"},
+		{method: http.MethodPost, path: "/v1/users/me/totp"},
+		{method: http.MethodPut, path: "/v1/users/me/totp"},
+		{method: http.MethodDelete, path: "/v1/users/me/totp"},
+		{method: http.MethodGet, path: "/v1/api-keys"},
+		{method: http.MethodPost, path: "/v1/api-keys"},
+		{method: http.MethodGet, path: "/v1/tokens"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if status := do(t, routes, tt.method, tt.path, authorization, map[string]string{}, nil); status != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", status, http.StatusForbidden)
+			}
+		})
+	}
+
+	// The same user can still export their data with a session.
+	if status := do(t, routes, http.MethodGet, "/v1/users/me/export", login(t, routes, "alice@example.com"), nil, nil); status != http.StatusOK {
+		t.Errorf("GET /v1/users/me/export with a session: got status %d, want %d", status, http.StatusOK)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -11,7 +14,7 @@ func (app *application) logError(r *http.Request, err error) {
 		uri    = r.URL.RequestURI()
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", app.contextGetRequestID(r))
 }
 
 // Generic helper to send JSON-formatted error responses
@@ -63,19 +66,38 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) loginBackoffResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	// Round up, so that clients which wait exactly this long aren't turned away again.
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	message := "too many failed login attempts, please wait before trying again"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your account is temporarily locked, please try again later"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
-	// Remind client that we expect them to authenticate using a bearer token.
+	// Remind client that we expect them to authenticate using a bearer token or API key.
 	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.Header().Add("WWW-Authenticate", "ApiKey")
 
 	message := "invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -90,3 +112,38 @@ func (app *application) nonPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your account does not have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) totpAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled for your account"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) invalidOIDCStateResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired login, please start again"
+	app.errorResponse(w, r, http.StatusBadRequest, message)
+}
+
+func (app *application) oidcLoginFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "login with the identity provider failed"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) unverifiedEmailResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider has not verified your email address"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) registrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration is by invitation only"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) accountPendingDeletionResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your account is scheduled for deletion, use the token emailed to you to cancel it"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -9,8 +9,10 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/nighon/greenlight/internal/data"
 	"github.com/nighon/greenlight/internal/validator"
 )
 
@@ -119,6 +121,25 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// readIDs reads a comma-separated list of IDs.
+func (app *application) readIDs(qs url.Values, key string, v *validator.Validator) []int64 {
+	csv := qs.Get(key)
+	if csv == "" {
+		return nil
+	}
+
+	var ids []int64
+	for _, s := range strings.Split(csv, ",") {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			v.AddError(key, "must be a comma-separated list of integers")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
 	s := qs.Get(key)
 	if s == "" {
@@ -132,6 +153,33 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return defaultValue
+	}
+	return b
+}
+
+// readTime reads an RFC 3339 timestamp, returning nil if it isn't set.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+	return &t
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
@@ -148,3 +196,13 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// permissionsForRequest returns the permissions the request is allowed to use: those set by
+// authenticate when it already knows them, otherwise the user's stored permissions.
+func (app *application) permissionsForRequest(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+
+	return app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+}
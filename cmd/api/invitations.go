@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+const (
+	registrationModeOpen   = "open"
+	registrationModeInvite = "invite"
+	registrationModeDomain = "domain"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+var errRegistrationClosed = errors.New("registration is closed")
+
+// registrationOpenTo reports whether someone can register with email without an invitation.
+func (app *application) registrationOpenTo(email string) bool {
+	switch app.config.registration.mode {
+	case registrationModeOpen:
+		return true
+	case registrationModeDomain:
+		_, domain, _ := strings.Cut(email, "@")
+		for _, allowed := range app.config.registration.domains {
+			if strings.EqualFold(domain, allowed) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string   `json:"email"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	invitation := &data.Invitation{
+		CreatedBy:   &admin.ID,
+		Email:       input.Email,
+		Permissions: input.Permissions,
+	}
+
+	// No permissions is the same as an empty list, unlike when replacing a user's.
+	if invitation.Permissions == nil {
+		invitation.Permissions = data.Permissions{}
+	}
+
+	codes, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateInvitation(v, invitation)
+	for _, code := range invitation.Permissions {
+		v.Check(validator.PermittedValue(code, codes...), "permissions", "must only contain known permissions")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Invitations.New(invitation, invitationTTL); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "invitation.create", TargetType: data.AuditTargetInvitation, TargetID: invitation.ID}, nil, invitation)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"inviteToken": invitation.Plaintext,
+			"email":       invitation.Email,
+		}
+
+		if err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", data); err != nil {
+			app.logger.Error("failed to send email", "error", err)
+		}
+	})
+
+	if err := app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafelist = []string{"id", "email", "expiry", "-id", "-email", "-expiry"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invitations, metadata, err := app.models.Invitations.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations, "metadata": metadata}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		invitation, err := m.Invitations.Delete(id)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "invitation.delete", TargetType: data.AuditTargetInvitation, TargetID: id}, invitation, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully deleted"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+// loginBackoff returns how much longer a client has to wait before its next login attempt
+// for email is considered. Each failure beyond the configured allowance doubles the wait,
+// whether it is counted against the email address or the client's IP address.
+func (app *application) loginBackoff(r *http.Request, email string) (time.Duration, error) {
+	now := time.Now()
+
+	stats, err := app.models.LoginFailures.GetStats(email, realip.FromRequest(r), now.Add(-app.config.lockout.window))
+	if err != nil {
+		return 0, err
+	}
+
+	wait := max(
+		backoffRemaining(stats.EmailCount-app.config.lockout.backoffAfter, stats.LastEmailFailure, now),
+		backoffRemaining(stats.IPCount-app.config.lockout.ipBackoffAfter, stats.LastIPFailure, now),
+	)
+
+	return min(wait, app.config.lockout.window), nil
+}
+
+func backoffRemaining(excess int, lastFailure *time.Time, now time.Time) time.Duration {
+	if excess <= 0 || lastFailure == nil {
+		return 0
+	}
+
+	// Cap the exponent well before it could overflow a Duration.
+	delay := time.Duration(math.Pow(2, float64(min(excess-1, 20)))) * time.Second
+
+	return max(lastFailure.Add(delay).Sub(now), 0)
+}
+
+// recordLoginFailure counts a failed login for email, and locks the user's account once
+// they reach the threshold. user is nil when no account has the email address.
+func (app *application) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	if err := app.models.LoginFailures.Insert(email, realip.FromRequest(r)); err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	stats, err := app.models.LoginFailures.GetStats(email, realip.FromRequest(r), time.Now().Add(-app.config.lockout.window))
+	if err != nil {
+		return err
+	}
+
+	if stats.EmailCount < app.config.lockout.threshold {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(app.config.lockout.duration)
+
+	if err := app.models.Users.SetLockedUntil(user.ID, &lockedUntil); err != nil {
+		return err
+	}
+
+	// Start counting afresh once the lock expires.
+	if err := app.models.LoginFailures.DeleteForEmail(email); err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"name":        user.Name,
+			"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+		}
+
+		if err := app.mailer.Send(user.Email, "user_account_locked.tmpl", data); err != nil {
+			app.logger.Error("failed to send email", "error", err)
+		}
+	})
+
+	return nil
+}
+
+// runLoginFailureCleanup periodically removes failures that no longer count towards any limit.
+func (app *application) runLoginFailureCleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := app.models.LoginFailures.DeleteOlderThan(time.Now().Add(-app.config.lockout.window)); err != nil {
+			app.logger.Error("failed to delete old login failures", "error", err)
+		}
+	}
+}
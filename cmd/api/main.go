@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
@@ -14,9 +18,14 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nighon/greenlight/internal/breached"
 	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/jwt"
 	"github.com/nighon/greenlight/internal/mailer"
+	"github.com/nighon/greenlight/internal/oidc"
+	"github.com/nighon/greenlight/internal/passhash"
 	"github.com/nighon/greenlight/internal/vcs"
+	"golang.org/x/crypto/bcrypt"
 
 	// Import the pq driver - it needs to register itself with the database/sql package
 	_ "github.com/lib/pq"
@@ -34,9 +43,13 @@ type config struct {
 		maxIdleTime  time.Duration
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps          float64
+		burst        int
+		enabled      bool
+		autocomplete struct {
+			rps   float64
+			burst int
+		}
 	}
 	smtp struct {
 		host     string
@@ -48,6 +61,48 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	pagination struct {
+		cursorKey string
+	}
+	password struct {
+		algorithm         string
+		bcryptCost        int
+		argon2Memory      int
+		argon2Iterations  int
+		argon2Parallelism int
+		minEntropy        float64
+		breachedFile      string
+	}
+	lockout struct {
+		window         time.Duration
+		backoffAfter   int
+		ipBackoffAfter int
+		threshold      int
+		duration       time.Duration
+	}
+	permissions struct {
+		cacheTTL  time.Duration
+		cacheSize int
+	}
+	auth struct {
+		mode            string
+		signingKeys     []string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+	}
+	registration struct {
+		mode    string
+		domains []string
+	}
+	deletion struct {
+		gracePeriod time.Duration
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
 }
 
 type application struct {
@@ -56,6 +111,13 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	// Only set when signed authentication tokens are enabled.
+	signer   *jwt.Keyset
+	denylist *denylist
+	// Only set when login through an OpenID Connect provider is enabled.
+	oidc *oidc.Provider
+	// Applied to every new password, see validateUser.
+	passwordPolicy data.PasswordPolicy
 }
 
 func main() {
@@ -72,12 +134,56 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", getEnvAsFloat64("LIMITER_RPS", 2), "Rate limit to apply to requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", getEnvAsInt("LIMITER_BURST", 4), "Burst limit to apply to requests")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", getEnvAsBool("LIMITER_ENABLED", true), "Enable rate limiting")
+	flag.Float64Var(&cfg.limiter.autocomplete.rps, "limiter-autocomplete-rps", getEnvAsFloat64("LIMITER_AUTOCOMPLETE_RPS", 10), "Rate limit to apply to autocomplete requests per second")
+	flag.IntVar(&cfg.limiter.autocomplete.burst, "limiter-autocomplete-burst", getEnvAsInt("LIMITER_AUTOCOMPLETE_BURST", 20), "Burst limit to apply to autocomplete requests")
 	flag.StringVar(&cfg.smtp.host, "smtp-host", getEnvAsString("SMTP_HOST", ""), "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", getEnvAsInt("SMTP_PORT", 25), "SMTP port")
 	flag.StringVar(&cfg.smtp.username, "smtp-username", getEnvAsString("SMTP_USERNAME", ""), "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", getEnvAsString("SMTP_PASSWORD", ""), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", getEnvAsString("SMTP_SENDER", ""), "SMTP sender")
 
+	flag.StringVar(&cfg.password.algorithm, "password-algorithm", getEnvAsString("PASSWORD_ALGORITHM", "argon2id"), "Algorithm to hash new passwords with (argon2id|bcrypt)")
+	flag.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", getEnvAsInt("PASSWORD_BCRYPT_COST", 12), "bcrypt cost")
+	flag.IntVar(&cfg.password.argon2Memory, "password-argon2-memory", getEnvAsInt("PASSWORD_ARGON2_MEMORY", 19*1024), "argon2id memory in KiB")
+	flag.IntVar(&cfg.password.argon2Iterations, "password-argon2-iterations", getEnvAsInt("PASSWORD_ARGON2_ITERATIONS", 2), "argon2id iterations")
+	flag.IntVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", getEnvAsInt("PASSWORD_ARGON2_PARALLELISM", 1), "argon2id parallelism")
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", getEnvAsFloat64("PASSWORD_MIN_ENTROPY", 35), "Minimum estimated password entropy in bits (0 disables)")
+	flag.StringVar(&cfg.password.breachedFile, "password-breached-file", getEnvAsString("PASSWORD_BREACHED_FILE", ""), "Sorted SHA-1 breached password file in HIBP format (disabled if empty)")
+
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", getEnvAsDuration("LOCKOUT_WINDOW", 15*time.Minute), "Period over which failed logins are counted")
+	flag.IntVar(&cfg.lockout.backoffAfter, "lockout-backoff-after", getEnvAsInt("LOCKOUT_BACKOFF_AFTER", 3), "Failed logins for an email address before further attempts are slowed down")
+	flag.IntVar(&cfg.lockout.ipBackoffAfter, "lockout-ip-backoff-after", getEnvAsInt("LOCKOUT_IP_BACKOFF_AFTER", 20), "Failed logins from an IP address before further attempts are slowed down")
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", getEnvAsInt("LOCKOUT_THRESHOLD", 10), "Failed logins for an account before it is locked")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", getEnvAsDuration("LOCKOUT_DURATION", 15*time.Minute), "How long an account stays locked")
+
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", getEnvAsDuration("PERMISSIONS_CACHE_TTL", time.Minute), "How long a user's permissions are cached for")
+	flag.IntVar(&cfg.permissions.cacheSize, "permissions-cache-size", getEnvAsInt("PERMISSIONS_CACHE_SIZE", 10000), "Maximum number of users whose permissions are cached (0 disables the cache)")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", getEnvAsString("AUTH_MODE", authModeOpaque), "Type of authentication tokens to issue (opaque|signed)")
+	cfg.auth.signingKeys = strings.Fields(getEnvAsString("AUTH_SIGNING_KEYS", ""))
+	flag.Func("auth-signing-keys", "Keys for signed authentication tokens, as kid:algorithm:base64-key (space separated, the first one signs)", func(s string) error {
+		cfg.auth.signingKeys = strings.Fields(s)
+		return nil
+	})
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", getEnvAsDuration("AUTH_ACCESS_TOKEN_TTL", 15*time.Minute), "Lifetime of authentication tokens")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", getEnvAsDuration("AUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour), "Lifetime of refresh tokens")
+
+	flag.StringVar(&cfg.registration.mode, "registration-mode", getEnvAsString("REGISTRATION_MODE", registrationModeOpen), "Who can register (open|invite|domain)")
+	cfg.registration.domains = strings.Fields(getEnvAsString("REGISTRATION_DOMAINS", ""))
+	flag.Func("registration-domains", "Email domains anyone can register with in domain mode (space separated)", func(s string) error {
+		cfg.registration.domains = strings.Fields(s)
+		return nil
+	})
+
+	flag.DurationVar(&cfg.deletion.gracePeriod, "deletion-grace-period", getEnvAsDuration("DELETION_GRACE_PERIOD", 14*24*time.Hour), "How long users have to cancel the deletion of their account")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", getEnvAsString("OIDC_ISSUER", ""), "OpenID Connect provider issuer URL (login through the provider is disabled if empty)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", getEnvAsString("OIDC_CLIENT_ID", ""), "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", getEnvAsString("OIDC_CLIENT_SECRET", ""), "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", getEnvAsString("OIDC_REDIRECT_URL", ""), "URL of GET /v1/oidc/callback as registered with the provider")
+
+	flag.StringVar(&cfg.pagination.cursorKey, "cursor-key", getEnvAsString("CURSOR_KEY", ""), "Base64 key that pagination cursors are signed with, shared by all instances (random if empty)")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
 		cfg.cors.trustedOrigins = strings.Fields(s)
 		return nil
@@ -94,6 +200,29 @@ func main() {
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	hasher, err := newPasswordHasher(cfg)
+	if err != nil {
+		logger.Error("error configuring password hashing", "error", err)
+		os.Exit(1)
+	}
+	data.SetPasswordHasher(hasher)
+
+	policy := data.PasswordPolicy{MinEntropy: cfg.password.minEntropy}
+	if cfg.password.breachedFile != "" {
+		policy.Breached, err = breached.Open(cfg.password.breachedFile)
+		if err != nil {
+			logger.Error("error opening breached password file", "error", err)
+			os.Exit(1)
+		}
+		defer policy.Breached.Close()
+	}
+
+	cursorKey, err := newCursorKey(cfg)
+	if err != nil {
+		logger.Error("error configuring cursor key", "error", err)
+		os.Exit(1)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.Error("error opening db", "error", err)
@@ -114,19 +243,144 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	var permissionCache *data.PermissionCache
+	if cfg.permissions.cacheSize > 0 {
+		permissionCache = data.NewPermissionCache(cfg.permissions.cacheTTL, cfg.permissions.cacheSize)
+
+		expvar.Publish("permission_cache", expvar.Func(func() any {
+			return permissionCache.Stats()
+		}))
+	}
+
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: data.NewModels(db, permissionCache, cursorKey),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
 	}
 
+	app.passwordPolicy = policy
+
+	if len(cfg.auth.signingKeys) > 0 {
+		app.signer, err = newKeyset(cfg.auth.signingKeys)
+		if err != nil {
+			logger.Error("error loading signing keys", "error", err)
+			os.Exit(1)
+		}
+
+		app.denylist = newDenylist()
+		if err := app.syncDenylist(); err != nil {
+			logger.Error("error loading token denylist", "error", err)
+			os.Exit(1)
+		}
+
+		go app.runDenylistSync(30 * time.Second)
+	}
+
+	if cfg.oidc.issuer != "" {
+		app.oidc, err = newOIDCProvider(cfg)
+		if err != nil {
+			logger.Error("error discovering OpenID Connect provider", "error", err)
+			os.Exit(1)
+		}
+
+		go app.runOIDCLoginCleanup(10 * time.Minute)
+	}
+
+	go app.runLoginFailureCleanup(10 * time.Minute)
+	go app.runAccountDeletion(10 * time.Minute)
+
+	if permissionCache != nil {
+		go app.listenForPermissionChanges(permissionCache)
+	}
+
+	switch {
+	case cfg.auth.mode != authModeOpaque && cfg.auth.mode != authModeSigned:
+		logger.Error("invalid authentication mode", "mode", cfg.auth.mode)
+		os.Exit(1)
+	case cfg.auth.mode == authModeSigned && app.signer == nil:
+		logger.Error("signed authentication tokens need at least one signing key")
+		os.Exit(1)
+	case cfg.registration.mode != registrationModeOpen && cfg.registration.mode != registrationModeInvite && cfg.registration.mode != registrationModeDomain:
+		logger.Error("invalid registration mode", "mode", cfg.registration.mode)
+		os.Exit(1)
+	}
+
 	if err := app.serve(); err != nil {
 		logger.Error("error starting server", "error", err)
 		os.Exit(1)
 	}
 }
 
+// newPasswordHasher hashes new passwords with the configured algorithm, but can verify
+// hashes produced by either.
+func newPasswordHasher(cfg config) (*passhash.Hasher, error) {
+	// Out of range values would otherwise be truncated by the conversions below, argon2
+	// panics on the first hash if the parallelism ends up as zero, and bcrypt fails every
+	// hash with a cost above its maximum.
+	switch p := cfg.password.argon2Parallelism; {
+	case p < 1 || p > 255:
+		return nil, fmt.Errorf("argon2id parallelism must be between 1 and 255, got %d", p)
+	case cfg.password.argon2Iterations < 1 || cfg.password.argon2Iterations > math.MaxUint32:
+		return nil, fmt.Errorf("argon2id iterations must be between 1 and %d, got %d", uint32(math.MaxUint32), cfg.password.argon2Iterations)
+	case cfg.password.argon2Memory < 8*p || cfg.password.argon2Memory > math.MaxUint32:
+		return nil, fmt.Errorf("argon2id memory must be at least %d KiB for a parallelism of %d, got %d", 8*p, p, cfg.password.argon2Memory)
+	case cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost:
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cfg.password.bcryptCost)
+	}
+
+	argon2id := passhash.Argon2id{
+		Memory:      uint32(cfg.password.argon2Memory),
+		Iterations:  uint32(cfg.password.argon2Iterations),
+		Parallelism: uint8(cfg.password.argon2Parallelism),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	bcryptAlgorithm := passhash.Bcrypt{Cost: cfg.password.bcryptCost}
+
+	switch cfg.password.algorithm {
+	case "argon2id":
+		return passhash.New(argon2id, bcryptAlgorithm), nil
+	case "bcrypt":
+		return passhash.New(bcryptAlgorithm, argon2id), nil
+	default:
+		return nil, fmt.Errorf("unknown password algorithm %q", cfg.password.algorithm)
+	}
+}
+
+// newCursorKey returns the configured key for signing pagination cursors, or a random one if
+// there is none, in which case cursors only work until the instance restarts.
+func newCursorKey(cfg config) ([]byte, error) {
+	if cfg.pagination.cursorKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(cfg.pagination.cursorKey)
+	if err != nil || len(key) < 32 {
+		return nil, errors.New("cursor key must be at least 32 bytes, base64 encoded")
+	}
+
+	return key, nil
+}
+
+func newKeyset(specs []string) (*jwt.Keyset, error) {
+	var keys []*jwt.Key
+
+	for _, spec := range specs {
+		key, err := jwt.ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewKeyset(keys...)
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNewPasswordHasherBcryptCost(t *testing.T) {
+	tests := []struct {
+		cost  int
+		valid bool
+	}{
+		{cost: 3},
+		{cost: 4, valid: true},
+		{cost: 12, valid: true},
+		{cost: 31, valid: true},
+		{cost: 32},
+	}
+
+	for _, tt := range tests {
+		var cfg config
+		cfg.password.algorithm = "bcrypt"
+		cfg.password.bcryptCost = tt.cost
+		cfg.password.argon2Memory = 64 * 1024
+		cfg.password.argon2Iterations = 3
+		cfg.password.argon2Parallelism = 2
+
+		if _, err := newPasswordHasher(cfg); (err == nil) != tt.valid {
+			t.Errorf("cost %d: got error %v, want valid %t", tt.cost, err, tt.valid)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
 	"net/http"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -12,6 +15,7 @@ import (
 	"time"
 
 	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/jwt"
 	"github.com/nighon/greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
@@ -40,60 +44,109 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestID gives every request an ID, which is sent back in the X-Request-ID header and
+// recorded with anything logged or audited for the request. An ID already set by a proxy in
+// front of the API is kept, as long as it looks sensible.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+
+		if !requestIDRX.MatchString(requestID) {
+			randomBytes := make([]byte, 16)
+			if _, err := rand.Read(randomBytes); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			requestID = hex.EncodeToString(randomBytes)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, requestID))
+	})
+}
+
+// clientLimiter rate limits requests by client IP address.
+type clientLimiter struct {
+	rps   float64
+	burst int
+
+	// Maps are not thread-safe. We need to lock the mutex before reading from the map.
+	mu      sync.Mutex
+	clients map[string]*limitedClient
+}
+
+type limitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(rps float64, burst int) *clientLimiter {
+	l := &clientLimiter{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*limitedClient),
 	}
-	var (
-		// Maps are not thread-safe. We need to lock the mutex before reading from the map.
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
 
 	// Background goroutine to clean up old clients.
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 
-			mu.Lock()
-			for ip, client := range clients {
+			l.mu.Lock()
+			for ip, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, ip)
 				}
 			}
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
+	return l
+}
+
+// allow reports whether the client at ip may make another request. It consumes a token from
+// the client's bucket if so.
+func (l *clientLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.clients[ip]; !found {
+		l.clients[ip] = &limitedClient{
+			limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst),
+		}
+	}
+
+	l.clients[ip].lastSeen = time.Now()
+
+	return l.clients[ip].limiter.Allow()
+}
+
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	limiter := newClientLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
+	// Type-ahead UIs autocomplete on every keystroke, so autocompletion has a limit of its own
+	// that doesn't use up the client's general one.
+	autocompleteLimiter := newClientLimiter(app.config.limiter.autocomplete.rps, app.config.limiter.autocomplete.burst)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.config.limiter.enabled {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		ip := realip.FromRequest(r)
-
-		mu.Lock()
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
-			}
+		l := limiter
+		if r.URL.Path == movieAutocompletePath {
+			l = autocompleteLimiter
 		}
 
-		clients[ip].lastSeen = time.Now()
-
-		// Check if the request is allowed by the rate limiter.
-		// `limiter.Allow()` returns `true` if the request is allowed, and `false` if the request is not allowed.
-		// It consumes a token from the bucket.
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
+		if !l.allow(realip.FromRequest(r)) {
 			app.rateLimitExceededResponse(w, r)
 			return
 		}
-		// We aren't using defer here because we want to unlock the mutex as soon as possible.
-		// If we deferred the unlock, it only would be executed after all the downstream handlers have returned.
-		mu.Unlock()
 
 		next.ServeHTTP(w, r)
 	})
@@ -106,20 +159,48 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		authorizationHeader := r.Header.Get("Authorization")
 		if authorizationHeader == "" {
-			app.contextSetUser(r, data.AnonymousUser)
+			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// We expect the value in the Authorization header to be in the format of "Bearer <token>".
+		// We expect the value in the Authorization header to be in the format of "Bearer <token>",
+		// or "ApiKey <key>" for service accounts.
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
+		if headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
 		token := headerParts[1]
 
+		// Signed tokens carry the user's ID, activation state and permissions, so they are
+		// verified without touching the database.
+		if app.signer != nil && jwt.LooksLikeJWT(token) {
+			claims, err := app.verifySignedToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+			r = app.contextSetToken(r, token)
+			r = app.contextSetPermissions(r, claims.Permissions)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate token
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -139,11 +220,75 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if err := app.models.Tokens.Touch(data.ScopeAuthentication, token); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAPIKey is the part of authenticate that handles API keys. Requests made with a
+// key only get the permissions that both the key and its owner currently have.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Keys outlive the sessions that are ended when the user is locked or deletion is
+	// scheduled, so they have to be refused here until the lock expires or is lifted, or the
+	// deletion is cancelled.
+	if user.IsLocked() || user.IsPendingDeletion() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	userPermissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions := data.Permissions{}
+	for _, code := range key.Permissions {
+		if userPermissions.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	if err := app.models.APIKeys.Touch(key.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, permissions)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -173,17 +318,37 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireSession refuses requests made with an API key. Otherwise a key could mint another
+// that never expires, end the sessions of the user it belongs to, or take over their account,
+// so keys, sessions and the account itself can only be managed by the user themselves.
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePermission only lets the request through if the user's permissions, including those
+// from their roles, grant code. See data.Permissions.Include for how wildcards are matched.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
+	return app.requireAnyPermission([]string{code}, next)
+}
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+// requireAnyPermission is like requirePermission, but lets the request through if any one of
+// the codes is granted. The handler is expected to check which one, when it matters.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.permissionsForRequest(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Include(code) {
+		if !slices.ContainsFunc(codes, permissions.Include) {
 			app.nonPermittedResponse(w, r)
 			return
 		}
@@ -253,14 +418,16 @@ func (mrw *metricsResponseWriter) Unwrap() http.ResponseWriter {
 	return mrw.wrapped
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	var (
-		totalRequestsReceived           = expvar.NewInt("total_requests_received")
-		totalResponsesSent              = expvar.NewInt("total_responses_sent")
-		totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
-		totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
-	)
+// The metrics are published once, rather than by metrics itself, since expvar panics if the
+// same name is published twice and the routes may be set up more than once, as in tests.
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+)
 
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateAnonymous(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	var anonymous bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Panics if authenticate didn't set a user.
+		anonymous = app.contextGetUser(r).IsAnonymous()
+	})
+
+	app.authenticate(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/users", nil))
+
+	if !anonymous {
+		t.Error("request without an Authorization header isn't anonymous")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/nighon/greenlight/internal/data"
 	"github.com/nighon/greenlight/internal/validator"
@@ -24,10 +25,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: &app.contextGetUser(r).ID,
 	}
 
 	v := validator.New()
@@ -37,7 +39,14 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := app.models.Movies.Insert(movie); err != nil {
+	err := app.models.Transaction(func(m data.Models) error {
+		if err := m.Movies.Insert(movie); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "movie.create", TargetType: data.AuditTargetMovie, TargetID: movie.ID}, nil, movie)
+	})
+	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
@@ -51,6 +60,13 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+	// httprouter can't route /v1/movies/autocomplete alongside /v1/movies/:id, so it ends up
+	// here.
+	if r.URL.Path == movieAutocompletePath {
+		app.autocompleteMoviesHandler(w, r)
+		return
+	}
+
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
@@ -91,6 +107,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if allowed, err := app.canWriteMovie(r, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if !allowed {
+		app.nonPermittedResponse(w, r)
+		return
+	}
+
 	// If the client provided an "X-Expected-Version" header, check that the version
 	// matches the version of the record being updated. If not, return a 409 Conflict
 	// status code.
@@ -101,6 +125,8 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	before := *movie
+
 	// Pointers' zero-value is nil, so turning these into pointers lets us do partial updates
 	// (whereas e.g. the string zero-value is "" - you wouldn't know if it was or wasn't supplied!)
 	var input struct {
@@ -135,7 +161,13 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Movies.Update(movie); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "movie.update", TargetType: data.AuditTargetMovie, TargetID: movie.ID}, before, movie)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -158,7 +190,32 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if allowed, err := app.canWriteMovie(r, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	} else if !allowed {
+		app.nonPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Movies.Delete(movie.ID); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "movie.delete", TargetType: data.AuditTargetMovie, TargetID: movie.ID}, movie, nil)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -176,8 +233,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieFilters
 		data.Filters
 	}
 
@@ -186,27 +242,124 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.GenresMode = app.readString(qs, "genres_mode", "any")
+	input.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	input.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+	input.IDs = app.readIDs(qs, "ids", v)
+	input.Search = app.readString(qs, "search", "")
+	input.Fuzzy = app.readBool(qs, "fuzzy", false, v)
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
-	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{
 		"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime",
 	}
 
+	// Search results are best first, unless the client asks for another order.
+	if input.Search != "" || input.Fuzzy {
+		input.Filters.Sort = app.readString(qs, "sort", "-relevance")
+		input.Filters.SortSafelist = append(input.Filters.SortSafelist, "-relevance")
+	} else {
+		input.Filters.Sort = app.readString(qs, "sort", "id")
+	}
+
+	// Passing cursor, even empty for the first page, switches to keyset pagination.
+	input.Filters.UseCursor = qs.Has("cursor")
+	input.Filters.Cursor = qs.Get("cursor")
+	input.Filters.OmitTotal = !app.readBool(qs, "include_total", true, v)
+
+	facets := app.readCSV(qs, "facets", []string{})
+
+	v.Check(!input.Filters.UseCursor || !qs.Has("page"), "page", "can't be used with cursor")
+	// Relevance isn't a column, so there is nothing for a cursor to remember.
+	v.Check(!input.Filters.UseCursor || input.Filters.Sort != "-relevance", "sort", "can't be used with cursor")
+
+	data.ValidateMovieFilters(v, input.MovieFilters)
+	app.models.Movies.ValidateCursor(v, input.Filters)
+
+	for _, facet := range facets {
+		v.Check(validator.PermittedValue(facet, data.MovieFacets...), "facets", "must only contain genres, decade or runtime_bucket")
+	}
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate values")
+
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.MovieFilters, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"movies": movies, "metadata": metadata}
+
+	// Facets are counted over every matching movie, not just this page, so that a UI can show
+	// them next to the results without paging through them all.
+	if len(facets) > 0 {
+		env["facets"], err = app.models.Movies.GetFacets(input.MovieFilters, facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+const movieAutocompletePath = "/v1/movies/autocomplete"
+
+// autocompleteMoviesHandler suggests movies for a type-ahead UI as the user types a title.
+// It is kept cheap so that it can be called on every keystroke.
+func (app *application) autocompleteMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	q := strings.TrimSpace(app.readString(qs, "q", ""))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 25, "limit", "must not be more than 25")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Autocomplete(q, limit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil); err != nil {
+	if err := app.writeJSON(w, http.StatusOK, envelope{"movies": suggestions}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// Either of these lets a user add movies. movies:write also lets them change or delete any
+// movie, while movies:write:own only lets them change or delete the ones they added.
+var movieWritePermissions = []string{"movies:write", "movies:write:own"}
+
+func (app *application) canWriteMovie(r *http.Request, movie *data.Movie) (bool, error) {
+	permissions, err := app.permissionsForRequest(r)
+	if err != nil {
+		return false, err
+	}
+
+	if permissions.Include("movies:write") {
+		return true, nil
+	}
+
+	return permissions.Include("movies:write:own") && movie.IsOwnedBy(app.contextGetUser(r).ID), nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/oidc"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+// The state of a login is also kept in a cookie, so that a callback is only accepted from
+// the browser that started the login. Otherwise someone could get a victim logged in to the
+// attacker's account by sending them the attacker's callback URL.
+const oidcStateCookie = "oidc_state"
+
+// How long the user has to log in with the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+var errUnverifiedEmail = errors.New("email address not verified by the identity provider")
+
+func newOIDCProvider(cfg config) (*oidc.Provider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return oidc.Discover(ctx, oidc.Config{
+		Issuer:       cfg.oidc.issuer,
+		ClientID:     cfg.oidc.clientID,
+		ClientSecret: cfg.oidc.clientSecret,
+		RedirectURL:  cfg.oidc.redirectURL,
+	})
+}
+
+// oidcStartHandler sends the user to the identity provider to log in. The provider sends
+// them back to oidcCallbackHandler.
+func (app *application) oidcStartHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := oidc.NewState()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	verifier, challenge, err := oidc.NewVerifier()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	login := &data.OIDCLogin{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Expiry:       time.Now().Add(oidcLoginTTL),
+	}
+
+	if err := app.models.OIDCLogins.Insert(login); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setOIDCStateCookie(w, state, int(oidcLoginTTL.Seconds()))
+
+	http.Redirect(w, r, app.oidc.AuthCodeURL(state, nonce, challenge), http.StatusFound)
+}
+
+// oidcCallbackHandler completes a login with the identity provider. The provider's identity
+// is linked to a user, who is created if necessary, and the user gets the same tokens as
+// for a password login.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	state := qs.Get("state")
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		app.invalidOIDCStateResponse(w, r)
+		return
+	}
+
+	app.setOIDCStateCookie(w, "", -1)
+
+	login, err := app.models.OIDCLogins.Consume(state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOIDCStateResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The user may have refused to log in, or the provider may have refused them.
+	if providerError := qs.Get("error"); providerError != "" {
+		app.logger.Info("identity provider returned an error", "error", providerError, "description", qs.Get("error_description"))
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(qs.Get("code") != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), qs.Get("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchange), errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.Info("identity provider login failed", "error", err)
+			app.oidcLoginFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var user *data.User
+	denied := denials{}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		var err error
+		user, err = app.userForIdentity(r, m, claims, denied)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			app.unverifiedEmailResponse(w, r)
+		case errors.Is(err, errRegistrationClosed):
+			app.registrationClosedResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateEmail), errors.Is(err, data.ErrDuplicateIdentity):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if user.IsLocked() {
+		app.accountLockedResponse(w, r)
+		return
+	}
+
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	// The provider only stands in for the password, so a second factor is still required
+	// if the user has enabled one.
+	enabled, err := app.totpEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		app.mfaRequiredResponse(w, r, user)
+		return
+	}
+
+	var authenticationToken, refreshToken *data.Token
+
+	err = app.models.Transaction(func(m data.Models) error {
+		var err error
+		authenticationToken, refreshToken, err = app.newSession(r, m, user)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}
+
+	if err := app.writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// userForIdentity returns the user linked to the identity in claims. An identity seen for the
+// first time is linked to the user with the same email address, or to a new user if there is
+// none, but only if the provider has verified the address: otherwise anyone could take over
+// an account by claiming its email address at the provider. Sessions it ends are added to
+// denied.
+func (app *application) userForIdentity(r *http.Request, m data.Models, claims *oidc.Claims, denied denials) (*data.User, error) {
+	user, err := m.Identities.GetUser(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	email := claims.Email
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, email); !claims.EmailVerified || !v.Valid() {
+		return nil, errUnverifiedEmail
+	}
+
+	user, err = m.Users.GetByEmail(email)
+	switch {
+	case err == nil:
+		// The provider has just verified the address, which is all activation does. But
+		// whoever registered the account never proved they own the address, so they might
+		// not be the user: the password they chose is replaced and their sessions ended.
+		if !user.Activated {
+			before := *user
+			user.Activated = true
+
+			password, err := oidc.NewState()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := user.Password.Set(password); err != nil {
+				return nil, err
+			}
+
+			if err := m.Users.Update(user); err != nil {
+				return nil, err
+			}
+
+			if err := app.endAllSessions(r, m, user.ID, &user.ID, denied); err != nil {
+				return nil, err
+			}
+
+			if err := app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.activate", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user); err != nil {
+				return nil, err
+			}
+		}
+
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createUserForIdentity(r, m, claims, email)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	identity := &data.Identity{
+		UserID:  user.ID,
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		Email:   email,
+	}
+
+	if err := m.Identities.Insert(identity); err != nil {
+		return nil, err
+	}
+
+	if err := app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.identity.link", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, identity); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (app *application) createUserForIdentity(r *http.Request, m data.Models, claims *oidc.Claims, email string) (*data.User, error) {
+	// An invitation for the address can be redeemed without its token, since the provider
+	// has verified that the address is the user's.
+	invitation, err := m.Invitations.ConsumeForEmail(email)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, err
+		}
+		if !app.registrationOpenTo(email) {
+			return nil, errRegistrationClosed
+		}
+	}
+
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	// Names are limited to 500 bytes, see data.ValidateUser.
+	name = truncateUTF8(name, 500)
+
+	user := &data.User{
+		Name:      name,
+		Email:     email,
+		Activated: true,
+	}
+
+	// The user logs in through the provider, so the password is one that nobody knows. They
+	// can still set their own through a password reset.
+	password, err := oidc.NewState()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := user.Password.Set(password); err != nil {
+		return nil, err
+	}
+
+	if err := m.Users.Insert(user); err != nil {
+		return nil, err
+	}
+
+	created, err := app.setUpNewUser(m, user, invitation)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.create", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, created); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// setOIDCStateCookie sets the state cookie, or deletes it if maxAge is negative. It has to be
+// sent on the top-level navigation back from the provider, so SameSite can't be strict.
+func (app *application) setOIDCStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/v1/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   app.config.env != "development",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// runOIDCLoginCleanup periodically removes logins that were started but never completed.
+func (app *application) runOIDCLoginCleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := app.models.OIDCLogins.DeleteExpired(); err != nil {
+			app.logger.Error("failed to delete expired OpenID Connect logins", "error", err)
+		}
+	}
+}
+
+// truncateUTF8 shortens s to at most n bytes, without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/nighon/greenlight/internal/oidc"
+)
+
+// newTestOIDCApplication returns an application whose identity provider is an in-process
+// server that only serves discovery, which is all that is needed before a login's state has
+// been checked.
+func newTestOIDCApplication(t *testing.T) *application {
+	t.Helper()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:      server.URL,
+		ClientID:    "greenlight",
+		RedirectURL: "https://greenlight.example.com/v1/oidc/callback",
+		HTTPClient:  server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		oidc:   provider,
+	}
+}
+
+func TestOIDCCallbackStateCookie(t *testing.T) {
+	app := newTestOIDCApplication(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string // Not sent if empty
+	}{
+		{name: "no cookie", query: "?state=abc&code=the-code"},
+		{name: "cookie doesn't match state", query: "?state=abc&code=the-code", cookie: "xyz"},
+		{name: "cookie is a prefix of state", query: "?state=abcd&code=the-code", cookie: "abc"},
+		{name: "no state", query: "?code=the-code", cookie: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/oidc/callback"+tt.query, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+
+			rr := httptest.NewRecorder()
+			app.oidcCallbackHandler(rr, r)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", rr.Code, http.StatusBadRequest)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != "invalid or expired login, please start again" {
+				t.Errorf("got error %q", body.Error)
+			}
+		})
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	for _, handler := range []http.HandlerFunc{app.oidcStartHandler, app.oidcCallbackHandler} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, "/v1/oidc/start", nil))
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("got status %d, want %d", rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{name: "short enough", s: "Zoë", n: 4, want: "Zoë"},
+		{name: "ASCII", s: "Alice", n: 3, want: "Ali"},
+		{name: "before a two-byte character", s: "Zoë", n: 3, want: "Zo"},
+		{name: "after a two-byte character", s: "Zoëy", n: 4, want: "Zoë"},
+		{name: "inside a four-byte character", s: "ab😀", n: 5, want: "ab"},
+		{name: "only a multi-byte character", s: "😀", n: 3, want: ""},
+		{name: "zero", s: "Alice", n: 0, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateUTF8(tt.s, tt.n)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q isn't valid UTF-8", got)
+			}
+		})
+	}
+}
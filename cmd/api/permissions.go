@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nighon/greenlight/internal/data"
+)
+
+// listenForPermissionChanges invalidates cached permissions as other instances change them.
+// While the connection is down notifications are lost, so the whole cache is dropped
+// whenever it is re-established.
+func (app *application) listenForPermissionChanges(cache *data.PermissionCache) {
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Error("permission change listener", "error", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(data.PermissionsChannel); err != nil {
+		app.logger.Error("failed to listen for permission changes", "error", err)
+		return
+	}
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			// A nil notification means the connection was re-established.
+			if notification == nil || notification.Extra == "*" {
+				cache.InvalidateAll()
+				continue
+			}
+
+			userID, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err != nil {
+				app.logger.Error("invalid permission change notification", "payload", notification.Extra)
+				cache.InvalidateAll()
+				continue
+			}
+
+			cache.Invalidate(userID)
+		case <-time.After(90 * time.Second):
+			// Check the connection is still alive, as a dead one would otherwise go unnoticed
+			// until the next notification failed to arrive.
+			go listener.Ping()
+		}
+	}
+}
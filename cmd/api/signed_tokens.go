@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nighon/greenlight/internal/data"
+)
+
+const (
+	authModeOpaque = "opaque"
+	authModeSigned = "signed"
+
+	signedTokenIssuer = "greenlight"
+)
+
+// signedTokenClaims is the payload of a signed authentication token. It carries everything
+// the authenticate and requirePermission middleware need, so that they don't have to look
+// the user up.
+type signedTokenClaims struct {
+	ID          string           `json:"jti"`
+	Issuer      string           `json:"iss"`
+	Subject     string           `json:"sub"`
+	IssuedAt    int64            `json:"iat"`
+	Expiry      int64            `json:"exp"`
+	Session     string           `json:"sid,omitempty"` // Family of the refresh token it was issued with
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+func (app *application) newSignedToken(user *data.User, session string) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTokenTTL)
+
+	claims := signedTokenClaims{
+		ID:          base64.RawURLEncoding.EncodeToString(randomBytes),
+		Issuer:      signedTokenIssuer,
+		Subject:     strconv.FormatInt(user.ID, 10),
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+		Session:     session,
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	plaintext, err := app.signer.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthentication,
+	}, nil
+}
+
+var errInvalidSignedToken = errors.New("invalid signed token")
+
+// verifySignedToken checks the token's signature and claims, and that it hasn't been revoked.
+func (app *application) verifySignedToken(token string) (*signedTokenClaims, error) {
+	var claims signedTokenClaims
+
+	if err := app.signer.Verify(token, &claims); err != nil {
+		return nil, errInvalidSignedToken
+	}
+
+	if claims.Issuer != signedTokenIssuer || time.Now().Unix() >= claims.Expiry {
+		return nil, errInvalidSignedToken
+	}
+
+	// Ending every session of a user denies the sessions themselves, since the IDs of the
+	// signed tokens issued for them aren't recorded.
+	if app.denylist.contains(claims.ID) || (claims.Session != "" && app.denylist.contains(claims.Session)) {
+		return nil, errInvalidSignedToken
+	}
+
+	return &claims, nil
+}
+
+// denylist is the in-memory copy of the token_denylist table, so that revoked signed tokens
+// can be rejected without a database lookup. Entries revoked by this instance are added as
+// soon as they are committed; those revoked by other instances arrive with the next sync.
+type denylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{entries: make(map[string]time.Time)}
+}
+
+func (d *denylist) add(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries[jti] = expiry
+}
+
+func (d *denylist) contains(jti string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, found := d.entries[jti]
+	return found
+}
+
+func (d *denylist) replace(entries map[string]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries = entries
+}
+
+// denials collects the token IDs and session families denied in a transaction, with their
+// expiry. They are only added to the in-memory denylist once the transaction has committed,
+// with applyDenials, so that a rollback can't leave them denied here but not in the table.
+type denials map[string]time.Time
+
+func (app *application) applyDenials(denied denials) {
+	for jti, expiry := range denied {
+		app.denylist.add(jti, expiry)
+	}
+}
+
+func (app *application) syncDenylist() error {
+	entries, err := app.models.Denylist.GetAllActive()
+	if err != nil {
+		return err
+	}
+
+	app.denylist.replace(entries)
+	return nil
+}
+
+// runDenylistSync periodically reloads the denylist and clears out expired entries.
+func (app *application) runDenylistSync(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if err := app.models.Denylist.DeleteExpired(); err != nil {
+			app.logger.Error("failed to delete expired denylist entries", "error", err)
+		}
+
+		if err := app.syncDenylist(); err != nil {
+			app.logger.Error("failed to sync token denylist", "error", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/nighon/greenlight/internal/jwt"
+)
+
+func newTestSigningApplication(t *testing.T) *application {
+	t.Helper()
+
+	key, err := jwt.ParseKey("k1:HS256:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jwt.NewKeyset(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{signer: signer, denylist: newDenylist()}
+}
+
+func TestVerifySignedToken(t *testing.T) {
+	app := newTestSigningApplication(t)
+
+	now := time.Now()
+	app.denylist.add("denied-jti", now.Add(time.Hour))
+	app.denylist.add("denied-session", now.Add(time.Hour))
+
+	valid := signedTokenClaims{
+		ID:       "jti",
+		Issuer:   signedTokenIssuer,
+		Subject:  "42",
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Minute).Unix(),
+		Session:  "session",
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *signedTokenClaims)
+		valid  bool
+	}{
+		{name: "valid", modify: func(c *signedTokenClaims) {}, valid: true},
+		{name: "expired", modify: func(c *signedTokenClaims) { c.Expiry = now.Add(-time.Second).Unix() }},
+		{name: "expires now", modify: func(c *signedTokenClaims) { c.Expiry = now.Unix() }},
+		{name: "no expiry", modify: func(c *signedTokenClaims) { c.Expiry = 0 }},
+		{name: "wrong issuer", modify: func(c *signedTokenClaims) { c.Issuer = "someone-else" }},
+		{name: "denied token", modify: func(c *signedTokenClaims) { c.ID = "denied-jti" }},
+		{name: "denied session", modify: func(c *signedTokenClaims) { c.Session = "denied-session" }},
+		{name: "no session", modify: func(c *signedTokenClaims) { c.Session = "" }, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid
+			tt.modify(&claims)
+
+			token, err := app.signer.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := app.verifySignedToken(token)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				if got.Subject != claims.Subject {
+					t.Errorf("got subject %q, want %q", got.Subject, claims.Subject)
+				}
+			} else if err != errInvalidSignedToken {
+				t.Errorf("got error %v, want %v", err, errInvalidSignedToken)
+			}
+		})
+	}
+}
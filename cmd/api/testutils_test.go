@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/mailer"
+	"github.com/nighon/greenlight/internal/passhash"
+	"github.com/nighon/greenlight/internal/testdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestApplication returns an application backed by a database of its own, configured as
+// main would with the default flags, but without rate limiting, and with mail going nowhere.
+// It is skipped without a test database, see testdb.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	db := testdb.New(t)
+
+	// The cheapest cost there is, so that the tests don't spend their time hashing.
+	data.SetPasswordHasher(passhash.New(passhash.Bcrypt{Cost: bcrypt.MinCost}))
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.smtp.host = "localhost"
+	cfg.smtp.port = 1
+	cfg.auth.mode = authModeOpaque
+	cfg.auth.accessTokenTTL = 15 * time.Minute
+	cfg.auth.refreshTokenTTL = 24 * time.Hour
+	cfg.registration.mode = registrationModeOpen
+	cfg.deletion.gracePeriod = 14 * 24 * time.Hour
+	cfg.lockout.window = 15 * time.Minute
+	cfg.lockout.backoffAfter = 3
+	cfg.lockout.ipBackoffAfter = 20
+	cfg.lockout.threshold = 10
+	cfg.lockout.duration = 15 * time.Minute
+
+	app := &application{
+		config: cfg,
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models: data.NewModels(db, nil, []byte("0123456789abcdef0123456789abcdef")),
+		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, "", "", "Greenlight <no-reply@greenlight.example.com>"),
+	}
+
+	// Emails are sent in the background, and fail, after the response has been written.
+	t.Cleanup(app.wg.Wait)
+
+	return app
+}
+
+// do sends a request through the application's routes and middleware, with body encoded as
+// JSON if it isn't nil, and decodes the response into dst if that isn't nil.
+func do(t *testing.T, handler http.Handler, method, path, authorization string, body, dst any) int {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	r := httptest.NewRequest(method, path, reqBody)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	if dst != nil {
+		if err := json.NewDecoder(rr.Body).Decode(dst); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+
+	return rr.Code
+}
+
+// newTestUser inserts an activated user with the given permissions.
+func newTestUser(t *testing.T, app *application, email string, permissions ...string) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(permissions) > 0 {
+		if err := app.models.Permissions.AddForUser(user.ID, permissions...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return user
+}
+
+// newTestAPIKey creates a key for user with the given permissions, and returns the
+// Authorization header to use it with.
+func newTestAPIKey(t *testing.T, app *application, user *data.User, permissions ...string) string {
+	t.Helper()
+
+	key := &data.APIKey{UserID: user.ID, Name: "test", Permissions: permissions}
+	if err := app.models.APIKeys.New(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return "ApiKey " + key.Plaintext
+}
+
+// login logs in as the user created by newTestUser with the given email, and returns the
+// Authorization header to use the authentication token with.
+func login(t *testing.T, handler http.Handler, email string) string {
+	t.Helper()
+
+	var tokens struct {
+		AuthenticationToken data.Token `json:"authentication_token"`
+	}
+
+	input := map[string]string{"email": email, "password": "correct horse battery staple"}
+	if status := do(t, handler, http.MethodPost, "/v1/tokens/authentication", "", input, &tokens); status != http.StatusCreated {
+		t.Fatalf("POST /v1/tokens/authentication: got status %d, want %d", status, http.StatusCreated)
+	}
+
+	return "Bearer " + tokens.AuthenticationToken.Plaintext
+}
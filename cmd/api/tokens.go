@@ -5,8 +5,11 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/nighon/greenlight/internal/data"
+	"github.com/nighon/greenlight/internal/jwt"
 	"github.com/nighon/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,10 +34,25 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	wait, err := app.loginBackoff(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		app.loginBackoffResponse(w, r, wait)
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			if err := app.recordLoginFailure(r, input.Email, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -42,6 +60,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// A locked account is refused before the password is checked, so that guessing can't
+	// carry on while the lock is in place.
+	if user.IsLocked() {
+		app.accountLockedResponse(w, r)
+		return
+	}
+
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -49,18 +74,599 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		if err := app.recordLoginFailure(r, input.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Checked after the password, so that only the user learns the account is going away.
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	if err := app.models.LoginFailures.DeleteForEmail(input.Email); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only time the plaintext is known, so take the chance to bring the hash up
+	// to date. The login shouldn't fail just because the upgrade did, so errors are only logged.
+	if user.Password.NeedsRehash() {
+		if err := user.Password.Set(input.Password); err != nil {
+			app.logger.Error("failed to rehash password", "error", err, "user_id", user.ID)
+		} else if err := app.models.Users.Update(user); err != nil {
+			app.logger.Error("failed to store rehashed password", "error", err, "user_id", user.ID)
+		}
+	}
+
+	enabled, err := app.totpEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// With two-factor authentication enabled the password alone only earns a short-lived
+	// token, which has to be exchanged along with a code at POST /v1/tokens/mfa.
+	if enabled {
+		app.mfaRequiredResponse(w, r, user)
+		return
+	}
+
+	var authenticationToken, refreshToken *data.Token
+
+	err = app.models.Transaction(func(m data.Models) error {
+		var err error
+		authenticationToken, refreshToken, err = app.newSession(r, m, user)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAPendingToken string `json:"mfa_pending_token"`
+		Code            string `json:"code"`
+		RecoveryCode    string `json:"recovery_code"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.MFAPendingToken)
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, input.MFAPendingToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Codes are much easier to guess than passwords, so failures count towards the same
+	// backoff and lockout.
+	wait, err := app.loginBackoff(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		app.loginBackoffResponse(w, r, wait)
+		return
+	}
+
+	if user.IsLocked() {
+		app.accountLockedResponse(w, r)
+		return
+	}
+
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		if err := app.recordLoginFailure(r, user.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if err := app.models.LoginFailures.DeleteForEmail(user.Email); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var authenticationToken, refreshToken *data.Token
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeMFAPending); err != nil {
+			return err
+		}
+
+		var err error
+		authenticationToken, refreshToken, err = app.newSession(r, m, user)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}
+
+	if err := app.writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var (
+		authenticationToken, refreshToken *data.Token
+		reused                            bool
+	)
+
+	err := app.models.Transaction(func(m data.Models) error {
+		var err error
+		authenticationToken, refreshToken, err = app.refreshSession(r, m, input.RefreshToken)
+
+		// The session has been revoked, which has to be committed even though the refresh
+		// failed.
+		if errors.Is(err, data.ErrTokenReused) {
+			reused = true
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if reused {
+		app.logger.Warn("refresh token reused, session revoked", "ip", realip.FromRequest(r), "request_id", app.contextGetRequestID(r))
+		app.invalidRefreshTokenResponse(w, r)
+		return
+	}
+
+	env := envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}
+
+	if err := app.writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Send the same response whether or not the email address belongs to a user, so that
+	// this endpoint can't be used to find out which addresses have an account.
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var token *data.Token
+
+	err = app.models.Transaction(func(m data.Models) error {
+		var err error
+		token, err = m.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		return app.auditTokenIssued(r, m, user, token)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.background(func() {
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		if err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data); err != nil {
+			app.logger.Error("failed to send email", "error", err)
+		}
+	})
+
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// As with password resets, the response doesn't depend on whether the address belongs
+	// to a user, or on whether that user has already been activated.
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && !user.Activated {
+		var token *data.Token
+
+		err := app.models.Transaction(func(m data.Models) error {
+			// Only the most recently sent activation token should be usable.
+			if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeActivation); err != nil {
+				return err
+			}
+
+			var err error
+			token, err = m.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				return err
+			}
+
+			return app.auditTokenIssued(r, m, user, token)
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+			}
+
+			if err := app.mailer.Send(user.Email, "token_activation.tmpl", data); err != nil {
+				app.logger.Error("failed to send email", "error", err)
+			}
+		})
+	}
+
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// httprouter won't register DELETE /v1/tokens/authentication alongside DELETE /v1/tokens/:id,
+// so both are served from the :id route and told apart here.
+func (app *application) deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	if params.ByName("id") == data.ScopeAuthentication {
+		app.deleteCurrentAuthenticationTokenHandler(w, r)
+		return
+	}
+
+	app.deleteSessionHandler(w, r)
+}
+
+func (app *application) deleteCurrentAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+	user := app.contextGetUser(r)
+
+	denied := denials{}
+
+	err := app.models.Transaction(func(m data.Models) error {
+		if app.signer != nil && jwt.LooksLikeJWT(token) {
+			// A signed token can't be deleted, so it is denied until it would have expired.
+			// Its refresh token is revoked too, so that the session ends here.
+			claims, err := app.verifySignedToken(token)
+			if err != nil {
+				return err
+			}
+
+			expiry := time.Unix(claims.Expiry, 0)
+
+			if err := m.Denylist.Insert(claims.ID, expiry); err != nil {
+				return err
+			}
+			denied[claims.ID] = expiry
+
+			if claims.Session != "" {
+				if err := m.Tokens.DeleteFamily(claims.Session); err != nil {
+					return err
+				}
+			}
+		} else if err := m.Tokens.DeleteSession(token); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "session.revoke", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, nil)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	denied := denials{}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		families, err := m.Tokens.DeleteSessionForUser(id, user.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := app.denySessions(m, families, denied); err != nil {
+			return err
+		}
+
+		revoked := struct {
+			SessionID int64 `json:"session_id"`
+		}{id}
+
+		return app.audit(r, m, data.AuditEvent{Action: "session.revoke", TargetType: data.AuditTargetUser, TargetID: user.ID}, revoked, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// mfaRequiredResponse issues the short-lived token that a user with two-factor authentication
+// enabled gets for their first factor, to be exchanged along with a code at POST /v1/tokens/mfa.
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request, user *data.User) {
+	var token *data.Token
+
+	err := app.models.Transaction(func(m data.Models) error {
+		var err error
+		token, err = m.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+		if err != nil {
+			return err
+		}
+
+		return app.auditTokenIssued(r, m, user, token)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"mfa_required": true, "mfa_pending_token": token}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newSession issues the authentication and refresh tokens for a new login through m, and
+// records it in the audit log. In signed mode the authentication token is signed rather than
+// stored.
+func (app *application) newSession(r *http.Request, m data.Models, user *data.User) (*data.Token, *data.Token, error) {
+	accessTTL := app.config.auth.accessTokenTTL
+	if app.config.auth.mode == authModeSigned {
+		accessTTL = 0
+	}
+
+	authenticationToken, refreshToken, err := m.Tokens.NewSession(user.ID, accessTTL, app.config.auth.refreshTokenTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if app.config.auth.mode == authModeSigned {
+		authenticationToken, err = app.newSignedToken(user, refreshToken.Family)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := app.auditSession(r, m, "session.create", refreshToken); err != nil {
+		return nil, nil, err
+	}
+
+	return authenticationToken, refreshToken, nil
+}
+
+// refreshSession exchanges a refresh token in the same way as newSession issues tokens.
+func (app *application) refreshSession(r *http.Request, m data.Models, refreshPlaintext string) (*data.Token, *data.Token, error) {
+	accessTTL := app.config.auth.accessTokenTTL
+	if app.config.auth.mode == authModeSigned {
+		accessTTL = 0
+	}
+
+	authenticationToken, refreshToken, err := m.Tokens.Refresh(refreshPlaintext, accessTTL, app.config.auth.refreshTokenTTL, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if app.config.auth.mode == authModeSigned {
+		// The signed token captures the user's current state, so it has to be read afresh.
+		user, err := m.Users.Get(refreshToken.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		authenticationToken, err = app.newSignedToken(user, refreshToken.Family)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := app.auditSession(r, m, "session.refresh", refreshToken); err != nil {
+		return nil, nil, err
+	}
+
+	return authenticationToken, refreshToken, nil
+}
+
+func (app *application) auditSession(r *http.Request, m data.Models, action string, refreshToken *data.Token) error {
+	session := struct {
+		SessionID int64 `json:"session_id"`
+	}{refreshToken.ID}
+
+	event := data.AuditEvent{ActorID: &refreshToken.UserID, Action: action, TargetType: data.AuditTargetUser, TargetID: refreshToken.UserID}
+
+	return app.audit(r, m, event, nil, session)
+}
+
+// endAllSessions logs the user out everywhere, through m. The denied sessions are added to
+// denied, to be applied once the transaction has committed. actorID is who ended them, or nil
+// for the authenticated user.
+func (app *application) endAllSessions(r *http.Request, m data.Models, userID int64, actorID *int64, denied denials) error {
+	families, err := m.Tokens.DeleteSessionsForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := app.denySessions(m, families, denied); err != nil {
+		return err
+	}
+
+	return app.audit(r, m, data.AuditEvent{ActorID: actorID, Action: "session.revoke_all", TargetType: data.AuditTargetUser, TargetID: userID}, nil, nil)
+}
+
+// denySessions denies the sessions with the given families, through m, once their tokens
+// have been deleted. Signed tokens can't be deleted, so their sessions are denied until any
+// token issued for them would have expired. The denied sessions are added to denied.
+func (app *application) denySessions(m data.Models, families []string, denied denials) error {
+	if app.signer == nil {
+		return nil
+	}
+
+	expiry := time.Now().Add(app.config.auth.accessTokenTTL)
+
+	for _, family := range families {
+		if err := m.Denylist.Insert(family, expiry); err != nil {
+			return err
+		}
+		denied[family] = expiry
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nighon/greenlight/internal/data"
+)
+
+// A signed access token can't be deleted along with its session, so revoking the session has
+// to deny it.
+func TestDeleteSessionSigned(t *testing.T) {
+	app := newTestApplication(t)
+
+	signing := newTestSigningApplication(t)
+	app.signer, app.denylist = signing.signer, signing.denylist
+	app.config.auth.mode = authModeSigned
+
+	routes := app.routes()
+
+	newTestUser(t, app, "alice@example.com")
+	authorization := login(t, routes, "alice@example.com")
+
+	var list struct {
+		Sessions []data.Session `json:"sessions"`
+	}
+	if status := do(t, routes, http.MethodGet, "/v1/tokens", authorization, nil, &list); status != http.StatusOK {
+		t.Fatalf("GET /v1/tokens: got status %d, want %d", status, http.StatusOK)
+	}
+	if len(list.Sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(list.Sessions))
+	}
+
+	path := fmt.Sprintf("/v1/tokens/%d", list.Sessions[0].ID)
+	if status := do(t, routes, http.MethodDelete, path, authorization, nil, nil); status != http.StatusOK {
+		t.Fatalf("DELETE %s: got status %d, want %d", path, status, http.StatusOK)
+	}
+
+	if status := do(t, routes, http.MethodGet, "/v1/users/me", authorization, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("token of the revoked session: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
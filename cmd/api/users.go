@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/nighon/greenlight/internal/data"
@@ -11,9 +12,10 @@ import (
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name        string `json:"name"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		InviteToken string `json:"invite_token"`
 	}
 
 	if err := app.readJSON(w, r, &input); err != nil {
@@ -21,10 +23,13 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Anyone with an invitation can register, whatever the registration mode.
+	invited := input.InviteToken != ""
+
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: false,
+		Activated: invited,
 	}
 
 	if err := user.Password.Set(input.Password); err != nil {
@@ -34,50 +39,508 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	if data.ValidateUser(v, user); !v.Valid() {
+	if invited {
+		v.Check(len(input.InviteToken) == 26, "invite_token", "must be 26 characters long")
+	}
+
+	if err := app.validateUser(v, user, &input.Password); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	if err := app.models.Users.Insert(user); err != nil {
+	if !invited && !app.registrationOpenTo(user.Email) {
+		switch app.config.registration.mode {
+		case registrationModeDomain:
+			v.AddError("email", "must be an address at an allowed domain, or you need an invitation")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.registrationClosedResponse(w, r)
+		}
+		return
+	}
+
+	var token *data.Token
+
+	err := app.models.Transaction(func(m data.Models) error {
+		var invitation *data.Invitation
+
+		if invited {
+			var err error
+			invitation, err = m.Invitations.Consume(input.InviteToken, user.Email)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := m.Users.Insert(user); err != nil {
+			return err
+		}
+
+		created, err := app.setUpNewUser(m, user, invitation)
+		if err != nil {
+			return err
+		}
+
+		if err := app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.create", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, created); err != nil {
+			return err
+		}
+
+		// An invitation is sent to the user's address, so redeeming it proves the address
+		// is theirs and there is nothing left to activate.
+		if invited {
+			return nil
+		}
+
+		token, err = m.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		return app.auditTokenIssued(r, m, user, token)
+	})
+	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invite_token", "invalid or expired invitation for this email address")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if token != nil {
+		app.background(func() {
+			data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+				"name":            user.Name,
+			}
+
+			if err := app.mailer.Send(user.Email, "user_welcome.tmpl", data); err != nil {
+				app.logger.Error("failed to send email", "error", err)
+			}
+		})
+	}
+
+	status := http.StatusAccepted
+	if invited {
+		status = http.StatusCreated
+	}
+
+	if err := app.writeJSON(w, status, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setUpNewUser gives a user who has just been inserted their initial roles, and the
+// permissions from the invitation they registered with, if any. It returns what was created,
+// for the audit log.
+func (app *application) setUpNewUser(m data.Models, user *data.User, invitation *data.Invitation) (any, error) {
+	roles := []string{"viewer"}
+
+	if err := m.Roles.AddForUser(user.ID, roles...); err != nil {
+		return nil, err
+	}
+
+	created := struct {
+		*data.User
+		Roles        []string         `json:"roles"`
+		Permissions  data.Permissions `json:"permissions,omitempty"`
+		InvitationID *int64           `json:"invitation_id,omitempty"`
+	}{User: user, Roles: roles}
+
+	if invitation != nil {
+		if len(invitation.Permissions) > 0 {
+			if err := m.Permissions.AddForUser(user.ID, invitation.Permissions...); err != nil {
+				return nil, err
+			}
+		}
+
+		created.Permissions = invitation.Permissions
+		created.InvitationID = &invitation.ID
+	}
+
+	return created, nil
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	before := *user
+	user.Activated = true
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeActivation); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.activate", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	if err := app.models.Permissions.AddForUser(user.ID, "movies:read"); err != nil {
+	if err := user.Password.Set(input.Password); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, "activation")
+	if err := app.validateUser(v, user, &input.Password); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	denied := denials{}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		// Revoke any other reset tokens, and log the user out everywhere in case the old
+		// password was compromised.
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopePasswordReset); err != nil {
+			return err
+		}
+
+		if err := app.endAllSessions(r, m, user.ID, &user.ID, denied); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.password_reset", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.applyDenials(denied)
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user, "roles": roles, "permissions": permissions}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	before := *user
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		// Changing the password needs the current one, so that a stolen authentication
+		// token can't be used to take over the account.
+		if input.CurrentPassword == nil {
+			v.AddError("current_password", "must be provided to change the password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		match, err := user.Password.Matches(*input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			v.AddError("current_password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		if err := user.Password.Set(*input.Password); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.validateUser(v, user, input.Password); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		if input.Password != nil {
+			// Any outstanding reset tokens were issued for the old password.
+			if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopePasswordReset); err != nil {
+				return err
+			}
+
+			if err := app.audit(r, m, data.AuditEvent{Action: "user.password_change", TargetType: data.AuditTargetUser, TargetID: user.ID}, nil, nil); err != nil {
+				return err
+			}
+		}
+
+		if user.Name == before.Name {
+			return nil
+		}
+
+		return app.audit(r, m, data.AuditEvent{Action: "user.update", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email address")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Catch addresses that are already taken now, rather than when the change is confirmed.
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.PendingEmail = &input.Email
+
+	var token *data.Token
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
+
+		// Tokens sent for an earlier pending address must not be able to confirm this one.
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeEmailChange); err != nil {
+			return err
+		}
+
+		var err error
+		token, err = m.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			return err
+		}
+
+		return app.auditTokenIssued(r, m, user, token)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	app.background(func() {
 		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"name":            user.Name,
+			"emailChangeToken": token.Plaintext,
+			"name":             user.Name,
 		}
 
-		if err := app.mailer.Send(user.Email, "user_welcome.tmpl", data); err != nil {
+		if err := app.mailer.Send(input.Email, "token_email_change.tmpl", data); err != nil {
 			app.logger.Error("failed to send email", "error", err)
 		}
 	})
 
-	if err := app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil); err != nil {
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		TokenPlaintext string `json:"token"`
 	}
@@ -94,11 +557,14 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err == nil && user.PendingEmail == nil {
+		err = data.ErrRecordNotFound
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", "invalid or expired email change token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -106,25 +572,65 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user.Activated = true
+	before := *user
+	user.Email = *user.PendingEmail
+	user.PendingEmail = nil
+
+	err = app.models.Transaction(func(m data.Models) error {
+		if err := m.Users.Update(user); err != nil {
+			return err
+		}
 
-	if err := app.models.Users.Update(user); err != nil {
+		if err := m.Tokens.DeleteAllForUser(user.ID, data.ScopeEmailChange); err != nil {
+			return err
+		}
+
+		return app.audit(r, m, data.AuditEvent{ActorID: &user.ID, Action: "user.email_change", TargetType: data.AuditTargetUser, TargetID: user.ID}, before, user)
+	})
+	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			// Someone registered the address after the change was requested.
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
-
 		}
 		return
 	}
 
-	if err := app.models.Tokens.DeleteAllForUser(user.ID, data.ScopeActivation); err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	app.background(func() {
+		data := map[string]interface{}{
+			"name":     user.Name,
+			"newEmail": user.Email,
+		}
+
+		if err := app.mailer.Send(before.Email, "user_email_changed.tmpl", data); err != nil {
+			app.logger.Error("failed to send email", "error", err)
+		}
+	})
 
 	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// currentUser returns the full record of the authenticated user. When a signed token was
+// used, the user in the request context only holds what the token's claims carry.
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	return app.models.Users.Get(app.contextGetUser(r).ID)
+}
+
+// validateUser is data.ValidateUser, plus the password policy when the user is given a new
+// password. An error is only returned if the policy couldn't be checked.
+func (app *application) validateUser(v *validator.Validator, user *data.User, password *string) error {
+	data.ValidateUser(v, user)
+
+	if password == nil || !v.Valid() {
+		return nil
+	}
+
+	return app.passwordPolicy.Validate(v, *password, user)
+}
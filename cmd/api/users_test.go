@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/nighon/greenlight/internal/data"
+)
+
+// Registration and the token requests that follow it are made without being logged in, but
+// the audit events they write still have the user as their actor.
+func TestRegisterUser(t *testing.T) {
+	app := newTestApplication(t)
+	routes := app.routes()
+
+	var registered struct {
+		User data.User `json:"user"`
+	}
+
+	input := map[string]string{"name": "Alice Smith", "email": "alice@example.com", "password": "correct horse battery staple"}
+	if status := do(t, routes, http.MethodPost, "/v1/users", "", input, &registered); status != http.StatusAccepted {
+		t.Fatalf("POST /v1/users: got status %d, want %d", status, http.StatusAccepted)
+	}
+
+	email := map[string]string{"email": "alice@example.com"}
+	for _, path := range []string{"/v1/tokens/activation", "/v1/tokens/password-reset"} {
+		if status := do(t, routes, http.MethodPost, path, "", email, nil); status != http.StatusAccepted {
+			t.Errorf("POST %s: got status %d, want %d", path, status, http.StatusAccepted)
+		}
+	}
+
+	events, err := app.models.Audit.GetAllForUser(registered.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+
+		if event.ActorID == nil || *event.ActorID != registered.User.ID {
+			t.Errorf("%s: got actor %v, want %d", event.Action, event.ActorID, registered.User.ID)
+		}
+	}
+
+	want := []string{"user.create", "token.issue", "token.issue", "token.issue"}
+	if !slices.Equal(actions, want) {
+		t.Errorf("got events %v, want %v", actions, want)
+	}
+}
@@ -0,0 +1,114 @@
+package breached
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// A line is a 40 character hash, a colon, the number of times it was seen and a line
+// ending. Counts never come close to filling the rest of this.
+const maxLineLength = 64
+
+// Corpus is a list of breached passwords in the format published by Have I Been Pwned: one
+// "SHA1:COUNT" line per password, ordered by hash. The file is searched in place rather than
+// loaded into memory, since the full list is tens of gigabytes.
+type Corpus struct {
+	file *os.File
+	size int64
+}
+
+func Open(path string) (*Corpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Corpus{file: file, size: info.Size()}, nil
+}
+
+func (c *Corpus) Close() error {
+	return c.file.Close()
+}
+
+// Contains reports whether password appears in the corpus.
+func (c *Corpus) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// Binary search over byte offsets. Each probe reads the first line that starts at or
+	// after the offset, and lo is always the start of a line.
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		hash, start, next, err := c.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		switch strings.Compare(hash, target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// lineAt returns the hash on the first line starting at or after offset, along with the
+// offsets of that line and the one after it.
+func (c *Corpus) lineAt(offset int64) (hash string, start, next int64, err error) {
+	start = offset
+	if offset > 0 {
+		// Read from the byte before the offset, so that a line starting exactly at the offset
+		// is found by its preceding newline.
+		start = offset - 1
+	}
+
+	buf := make([]byte, 2*maxLineLength)
+	n, err := c.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return "", 0, 0, err
+	}
+	buf = buf[:n]
+
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			// No line starts before the end of the file.
+			return "", c.size, c.size, nil
+		}
+		buf = buf[i+1:]
+		start += int64(i + 1)
+	}
+
+	line := buf
+	next = start + int64(len(buf))
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		line = buf[:i]
+		next = start + int64(i+1)
+	}
+
+	hash, _, _ = strings.Cut(strings.TrimSpace(string(line)), ":")
+
+	return strings.ToUpper(hash), start, next, nil
+}
@@ -0,0 +1,170 @@
+package breached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeCorpus writes the hashes of passwords to a corpus file, ordered by hash, and returns
+// the passwords in the same order.
+func writeCorpus(t *testing.T, passwords []string, lineEnding string, trailing bool) (string, []string) {
+	t.Helper()
+
+	sorted := slices.Clone(passwords)
+	slices.SortFunc(sorted, func(a, b string) int {
+		return strings.Compare(sha1Hex(a), sha1Hex(b))
+	})
+
+	lines := make([]string, len(sorted))
+	for i, password := range sorted {
+		lines[i] = fmt.Sprintf("%s:%d", sha1Hex(password), i*37+1)
+	}
+
+	content := strings.Join(lines, lineEnding)
+	if trailing && len(lines) > 0 {
+		content += lineEnding
+	}
+
+	path := filepath.Join(t.TempDir(), "corpus.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, sorted
+}
+
+func openCorpus(t *testing.T, path string) *Corpus {
+	t.Helper()
+
+	corpus, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { corpus.Close() })
+
+	return corpus
+}
+
+func TestContains(t *testing.T) {
+	var passwords []string
+	for i := range 500 {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+
+	formats := []struct {
+		name       string
+		lineEnding string
+		trailing   bool
+	}{
+		{name: "LF", lineEnding: "\n", trailing: true},
+		{name: "CRLF", lineEnding: "\r\n", trailing: true},
+		{name: "no trailing newline", lineEnding: "\n"},
+	}
+
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			path, sorted := writeCorpus(t, passwords, format.lineEnding, format.trailing)
+			corpus := openCorpus(t, path)
+
+			tests := []struct {
+				name     string
+				password string
+				want     bool
+			}{
+				{name: "first line", password: sorted[0], want: true},
+				{name: "second line", password: sorted[1], want: true},
+				{name: "middle line", password: sorted[len(sorted)/2], want: true},
+				{name: "second to last line", password: sorted[len(sorted)-2], want: true},
+				{name: "last line", password: sorted[len(sorted)-1], want: true},
+				{name: "absent", password: "not in the corpus"},
+				{name: "empty", password: ""},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					got, err := corpus.Contains(tt.password)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got != tt.want {
+						t.Errorf("got %t, want %t", got, tt.want)
+					}
+				})
+			}
+
+			for _, password := range sorted {
+				if got, err := corpus.Contains(password); err != nil || !got {
+					t.Fatalf("%q: got %t, %v", password, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestContainsAbsentAtEnds(t *testing.T) {
+	var passwords []string
+	for i := range 100 {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+	_, sorted := writeCorpus(t, passwords, "\n", true)
+
+	// Leave out the passwords with the smallest, a middle and the largest hash, so that
+	// there are absent hashes before the first line, between two lines and after the last.
+	middle := len(sorted) / 2
+	absent := []string{sorted[0], sorted[middle], sorted[len(sorted)-1]}
+	present := slices.Concat(sorted[1:middle], sorted[middle+1:len(sorted)-1])
+
+	path, _ := writeCorpus(t, present, "\n", true)
+	corpus := openCorpus(t, path)
+
+	for _, password := range absent {
+		if got, err := corpus.Contains(password); err != nil || got {
+			t.Errorf("%q: got %t, %v", password, got, err)
+		}
+	}
+
+	for _, password := range []string{present[0], present[len(present)-1]} {
+		if got, err := corpus.Contains(password); err != nil || !got {
+			t.Errorf("%q: got %t, %v", password, got, err)
+		}
+	}
+}
+
+func TestContainsSmallCorpora(t *testing.T) {
+	tests := []struct {
+		name      string
+		passwords []string
+	}{
+		{name: "empty"},
+		{name: "one line", passwords: []string{"pa55word"}},
+		{name: "two lines", passwords: []string{"pa55word", "password"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, sorted := writeCorpus(t, tt.passwords, "\n", true)
+			corpus := openCorpus(t, path)
+
+			for _, password := range sorted {
+				if got, err := corpus.Contains(password); err != nil || !got {
+					t.Errorf("%q: got %t, %v", password, got, err)
+				}
+			}
+
+			if got, err := corpus.Contains("not in the corpus"); err != nil || got {
+				t.Errorf("absent password: got %t, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Types of thing that audit events can target.
+const (
+	AuditTargetMovie      = "movie"
+	AuditTargetUser       = "user"
+	AuditTargetAPIKey     = "api_key"
+	AuditTargetInvitation = "invitation"
+)
+
+// AuditEvent records a change made through the API, who made it and what it changed.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *int64          `json:"actor_id"` // nil for anonymous requests
+	IP         string          `json:"ip"`
+	Action     string          `json:"action"` // e.g. "movie.update"
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"request_id"`
+}
+
+// SetChanges records before and after as JSON, leaving out any top-level fields that are the
+// same in both so that an update only records what it changed. Either may be nil, e.g. for a
+// create or a delete, in which case the other is recorded in full.
+func (e *AuditEvent) SetChanges(before, after any) error {
+	var err error
+
+	if before != nil {
+		if e.Before, err = json.Marshal(before); err != nil {
+			return err
+		}
+	}
+
+	if after != nil {
+		if e.After, err = json.Marshal(after); err != nil {
+			return err
+		}
+	}
+
+	if e.Before == nil || e.After == nil {
+		return nil
+	}
+
+	var beforeFields, afterFields map[string]json.RawMessage
+
+	// Only objects can be compared field by field; anything else is kept as it is.
+	if json.Unmarshal(e.Before, &beforeFields) != nil || json.Unmarshal(e.After, &afterFields) != nil {
+		return nil
+	}
+
+	for key, value := range beforeFields {
+		if other, ok := afterFields[key]; ok && bytes.Equal(value, other) {
+			delete(beforeFields, key)
+			delete(afterFields, key)
+		}
+	}
+
+	if e.Before, err = json.Marshal(beforeFields); err != nil {
+		return err
+	}
+
+	e.After, err = json.Marshal(afterFields)
+	return err
+}
+
+// AuditFilters narrows down the audit events returned by GetAll. Zero values match anything.
+type AuditFilters struct {
+	ActorID    int64
+	Action     string
+	TargetType string
+	TargetID   int64
+	RequestID  string
+	Since      *time.Time
+	Until      *time.Time
+}
+
+type AuditModel struct {
+	DB DBTX
+}
+
+// Insert records the event. To make sure it is only recorded if the change it describes is
+// made, the model should be bound to the same transaction as the change.
+func (m AuditModel) Insert(event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (actor_id, ip, action, target_type, target_id, before, after, request_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+
+	args := []interface{}{
+		event.ActorID,
+		event.IP,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		nullJSON(event.Before),
+		nullJSON(event.After),
+		event.RequestID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+func (m AuditModel) GetAll(auditFilters AuditFilters, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, actor_id, ip, action, target_type, target_id, before, after, request_id
+		FROM audit_events
+		WHERE (actor_id = $1 OR $1 = 0)
+		AND (action = $2 OR $2 = '')
+		AND (target_type = $3 OR $3 = '')
+		AND (target_id = $4 OR $4 = 0)
+		AND (request_id = $5 OR $5 = '')
+		AND (created_at >= $6 OR $6::timestamptz IS NULL)
+		AND (created_at < $7 OR $7::timestamptz IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $8 OFFSET $9`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{
+		auditFilters.ActorID,
+		auditFilters.Action,
+		auditFilters.TargetType,
+		auditFilters.TargetID,
+		auditFilters.RequestID,
+		auditFilters.Since,
+		auditFilters.Until,
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var (
+			event         AuditEvent
+			before, after []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.IP,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&before,
+			&after,
+			&event.RequestID,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		event.Before = before
+		event.After = after
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// GetAllForUser returns every event the user was the actor or the target of, oldest first,
+// for exporting their data. The changes are only included for events that targeted the user,
+// and the IP address only for those the user also made, so that an admin's export doesn't
+// contain the data of the users they changed, nor those users' exports the admin's address.
+func (m AuditModel) GetAllForUser(userID int64) ([]*AuditEvent, error) {
+	query := `
+		SELECT id, created_at, actor_id, ip, action, target_type, target_id, before, after, request_id
+		FROM audit_events
+		WHERE actor_id = $1 OR (target_type = $2 AND target_id = $1)
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, AuditTargetUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var (
+			event         AuditEvent
+			before, after []byte
+		)
+
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.IP,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&before,
+			&after,
+			&event.RequestID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ownTarget := event.TargetType == AuditTargetUser && event.TargetID == userID
+		ownAction := event.ActorID != nil && *event.ActorID == userID
+
+		if ownTarget {
+			event.Before = before
+			event.After = after
+		}
+
+		if !ownTarget || !ownAction {
+			event.IP = ""
+		}
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// AnonymiseForUser removes the personal data that events about a deleted user recorded, i.e.
+// the changes made to them and the IP addresses they acted from. What happened, and when,
+// is kept.
+func (m AuditModel) AnonymiseForUser(userID int64) error {
+	query := `
+		UPDATE audit_events
+		SET
+			before = CASE WHEN target_type = $2 AND target_id = $1 THEN NULL ELSE before END,
+			after = CASE WHEN target_type = $2 AND target_id = $1 THEN NULL ELSE after END,
+			ip = CASE WHEN actor_id = $1 THEN '' ELSE ip END
+		WHERE actor_id = $1 OR (target_type = $2 AND target_id = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, AuditTargetUser)
+	return err
+}
+
+// nullJSON stores missing JSON as NULL rather than as an empty string, which isn't valid JSON.
+func nullJSON(value json.RawMessage) any {
+	if value == nil {
+		return nil
+	}
+	return string(value)
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// DenylistModel stores the IDs of signed tokens that were revoked before they expired.
+// Signed tokens are verified without a database lookup, so callers are expected to keep
+// an in-memory copy of the active entries.
+type DenylistModel struct {
+	DB DBTX
+}
+
+func (m DenylistModel) Insert(jti string, expiry time.Time) error {
+	query := `
+		INSERT INTO token_denylist (jti, expiry)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	return err
+}
+
+// GetAllActive returns the unexpired entries, mapped to their expiry.
+func (m DenylistModel) GetAllActive() (map[string]time.Time, error) {
+	query := `
+		SELECT jti, expiry
+		FROM token_denylist
+		WHERE expiry > $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			jti    string
+			expiry time.Time
+		)
+		if err := rows.Scan(&jti, &expiry); err != nil {
+			return nil, err
+		}
+		entries[jti] = expiry
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// DeleteExpired removes entries for tokens that would no longer be accepted anyway.
+func (m DenylistModel) DeleteExpired() error {
+	query := `
+		DELETE FROM token_denylist
+		WHERE expiry <= $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now())
+	return err
+}
@@ -1,6 +1,12 @@
 package data
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/nighon/greenlight/internal/validator"
@@ -11,6 +17,13 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// With UseCursor set, results are paged through by keyset rather than by offset, which
+	// stays fast however deep the page. Cursor is empty for the first page, and otherwise
+	// one of the cursors from the previous page's Metadata.
+	UseCursor bool
+	Cursor    string
+	// Skips counting the total number of records, which is costly for large result sets.
+	OmitTotal bool
 }
 
 func (f Filters) sortColumn() string {
@@ -51,12 +64,124 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
 }
 
+// validateCursor checks that the cursor in f, if any, was signed with key and is for the
+// sort it is used with.
+func validateCursor(v *validator.Validator, key []byte, f Filters) {
+	if f.UseCursor && f.Cursor != "" {
+		c, err := decodeCursor(key, f.Cursor)
+		v.Check(err == nil, "cursor", "invalid cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "must be used with the sort it was returned for")
+	}
+}
+
+// cursor marks a position in a sorted list of results: the sort value and ID of the row
+// next to it. Backward cursors page towards the start of the list.
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       int64  `json:"id"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor returns c signed with key, so that clients can't make up their own cursors.
+// They can still read them, but there is nothing secret in a cursor.
+func encodeCursor(key []byte, c cursor) string {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		// The struct only has strings, numbers and bools, which always marshal.
+		panic(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func decodeCursor(key []byte, s string) (cursor, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(s, ".")
+	if !ok {
+		return cursor{}, errInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return cursor{}, errInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return cursor{}, errInvalidCursor
+	}
+
+	return c, nil
+}
+
+// keysetCondition returns the condition for the rows after c in the sort order, or before
+// it for a backward cursor. Ties on the sort column are always broken by ascending ID,
+// whichever way the column is sorted, so the condition can't be a simple row comparison.
+func (f Filters) keysetCondition(c cursor, args *queryArgs) string {
+	column := f.sortColumn()
+
+	after := f.sortDirection() == "ASC"
+	if c.Backward {
+		after = !after
+	}
+
+	columnOp := "<"
+	if after {
+		columnOp = ">"
+	}
+
+	idOp := ">"
+	if c.Backward {
+		idOp = "<"
+	}
+
+	value := args.add(c.Value)
+
+	return fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[4]s %[5]s))", column, columnOp, value, idOp, args.add(c.ID))
+}
+
+// keysetOrder returns the ORDER BY for paging with c, which is the reverse of the usual
+// order when paging backward. The rows then have to be reversed again.
+func (f Filters) keysetOrder(c cursor) string {
+	direction, idDirection := f.sortDirection(), "ASC"
+
+	if c.Backward {
+		if direction == "ASC" {
+			direction = "DESC"
+		} else {
+			direction = "ASC"
+		}
+		idDirection = "DESC"
+	}
+
+	return fmt.Sprintf("%s %s, id %s", f.sortColumn(), direction, idDirection)
+}
+
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -72,3 +197,13 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// queryArgs collects the arguments for a query that is put together piece by piece, so that
+// every value is passed as a parameter rather than written into the SQL.
+type queryArgs []any
+
+// add appends value to the arguments and returns the placeholder for it.
+func (a *queryArgs) add(value any) string {
+	*a = append(*a, value)
+	return fmt.Sprintf("$%d", len(*a))
+}
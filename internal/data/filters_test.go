@@ -0,0 +1,255 @@
+package data
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+var testCursorKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestKeysetQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		sort          string
+		backward      bool
+		wantCondition string
+		wantOrder     string
+	}{
+		{name: "ASC forward", sort: "year", wantCondition: "(year > $1 OR (year = $1 AND id > $2))", wantOrder: "year ASC, id ASC"},
+		{name: "ASC backward", sort: "year", backward: true, wantCondition: "(year < $1 OR (year = $1 AND id < $2))", wantOrder: "year DESC, id DESC"},
+		{name: "DESC forward", sort: "-year", wantCondition: "(year < $1 OR (year = $1 AND id > $2))", wantOrder: "year DESC, id ASC"},
+		{name: "DESC backward", sort: "-year", backward: true, wantCondition: "(year > $1 OR (year = $1 AND id < $2))", wantOrder: "year ASC, id DESC"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Filters{Sort: tt.sort, SortSafelist: []string{"year", "-year"}}
+			c := cursor{Sort: tt.sort, Value: "2001", ID: 7, Backward: tt.backward}
+
+			var args queryArgs
+			if got := f.keysetCondition(c, &args); got != tt.wantCondition {
+				t.Errorf("got condition %q, want %q", got, tt.wantCondition)
+			}
+			if len(args) != 2 || args[0] != "2001" || args[1] != int64(7) {
+				t.Errorf("got args %v", args)
+			}
+
+			if got := f.keysetOrder(c); got != tt.wantOrder {
+				t.Errorf("got order %q, want %q", got, tt.wantOrder)
+			}
+		})
+	}
+}
+
+type keysetRow struct {
+	id   int64
+	year int
+}
+
+var (
+	conditionPattern = regexp.MustCompile(`^\(year ([<>]) \$1 OR \(year = \$1 AND id ([<>]) \$2\)\)$`)
+	orderPattern     = regexp.MustCompile(`^year (ASC|DESC), id (ASC|DESC)$`)
+)
+
+// keysetPage does what getAllByCursor's query does, against rows in memory: it keeps the
+// rows matching the keyset condition, orders them, and takes the first limit of them.
+func keysetPage(t *testing.T, rows []keysetRow, f Filters, c *cursor, limit int) []keysetRow {
+	t.Helper()
+
+	var page []keysetRow
+
+	if c == nil {
+		page = slices.Clone(rows)
+		c = &cursor{}
+	} else {
+		var args queryArgs
+		match := conditionPattern.FindStringSubmatch(f.keysetCondition(*c, &args))
+		if match == nil {
+			t.Fatalf("unexpected condition %q", f.keysetCondition(*c, &args))
+		}
+
+		value, err := strconv.Atoi(c.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, row := range rows {
+			if compare(row.year, value, match[1]) || (row.year == value && compare(row.id, c.ID, match[2])) {
+				page = append(page, row)
+			}
+		}
+	}
+
+	match := orderPattern.FindStringSubmatch(f.keysetOrder(*c))
+	if match == nil {
+		t.Fatalf("unexpected order %q", f.keysetOrder(*c))
+	}
+
+	slices.SortFunc(page, func(a, b keysetRow) int {
+		if a.year != b.year {
+			return direction(match[1]) * (a.year - b.year)
+		}
+		return direction(match[2]) * int(a.id-b.id)
+	})
+
+	if len(page) > limit {
+		page = page[:limit]
+	}
+
+	if c.Backward {
+		slices.Reverse(page)
+	}
+
+	return page
+}
+
+func compare[T int | int64](a, b T, op string) bool {
+	if op == "<" {
+		return a < b
+	}
+	return a > b
+}
+
+func direction(d string) int {
+	if d == "DESC" {
+		return -1
+	}
+	return 1
+}
+
+func TestKeysetPaging(t *testing.T) {
+	// Runs of tied years, with IDs out of order, so that pages have to be split between ties.
+	rows := []keysetRow{
+		{id: 9, year: 1999}, {id: 2, year: 2001}, {id: 5, year: 1999}, {id: 1, year: 2010},
+		{id: 7, year: 2001}, {id: 3, year: 2001}, {id: 8, year: 1985}, {id: 4, year: 2001},
+		{id: 6, year: 2010}, {id: 10, year: 1999}, {id: 11, year: 2001},
+	}
+
+	tests := []struct {
+		sort string
+		want []int64 // IDs in sort order, with ties by ascending ID
+	}{
+		{sort: "year", want: []int64{8, 5, 9, 10, 2, 3, 4, 7, 11, 1, 6}},
+		{sort: "-year", want: []int64{1, 6, 2, 3, 4, 7, 11, 5, 9, 10, 8}},
+	}
+
+	for _, tt := range tests {
+		f := Filters{Sort: tt.sort, SortSafelist: []string{"year", "-year"}}
+
+		for _, pageSize := range []int{1, 2, 3, 4, 11} {
+			t.Run(tt.sort+"/"+strconv.Itoa(pageSize), func(t *testing.T) {
+				// Forward from the start, with a cursor after the last row of each page.
+				var pages [][]keysetRow
+				var c *cursor
+				for {
+					page := keysetPage(t, rows, f, c, pageSize)
+					if len(page) == 0 {
+						break
+					}
+					pages = append(pages, page)
+
+					last := page[len(page)-1]
+					c = &cursor{Sort: tt.sort, Value: strconv.Itoa(last.year), ID: last.id}
+				}
+
+				if got := ids(slices.Concat(pages...)); !slices.Equal(got, tt.want) {
+					t.Fatalf("forward: got %v, want %v", got, tt.want)
+				}
+
+				// Backward from the last page, with a cursor before the first row of each page,
+				// which should give the same pages again.
+				for i := len(pages) - 1; i > 0; i-- {
+					first := pages[i][0]
+					c := &cursor{Sort: tt.sort, Value: strconv.Itoa(first.year), ID: first.id, Backward: true}
+
+					if got, want := ids(keysetPage(t, rows, f, c, pageSize)), ids(pages[i-1]); !slices.Equal(got, want) {
+						t.Errorf("backward from page %d: got %v, want %v", i, got, want)
+					}
+				}
+
+				// Nothing before the first row.
+				first := pages[0][0]
+				c = &cursor{Sort: tt.sort, Value: strconv.Itoa(first.year), ID: first.id, Backward: true}
+				if got := keysetPage(t, rows, f, c, pageSize); len(got) != 0 {
+					t.Errorf("backward from the first page: got %v", ids(got))
+				}
+			})
+		}
+	}
+}
+
+func ids(rows []keysetRow) []int64 {
+	var ids []int64
+	for _, row := range rows {
+		ids = append(ids, row.id)
+	}
+	return ids
+}
+
+func TestCursorSigning(t *testing.T) {
+	want := cursor{Sort: "-year", Value: "2001", ID: 7, Backward: true}
+	encoded := encodeCursor(testCursorKey, want)
+
+	got, err := decodeCursor(testCursorKey, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	forged := encodeCursor([]byte("another key, not the server's one"), want)
+	payload, signature, _ := strings.Cut(encoded, ".")
+	_, forgedSignature, _ := strings.Cut(forged, ".")
+	changedPayload, _, _ := strings.Cut(encodeCursor(testCursorKey, cursor{Sort: "-year", Value: "1900", ID: 7}), ".")
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "other key", cursor: forged},
+		{name: "payload with other key's signature", cursor: payload + "." + forgedSignature},
+		{name: "changed payload", cursor: changedPayload + "." + signature},
+		{name: "no signature", cursor: payload},
+		{name: "not base64", cursor: "!!.!!"},
+		{name: "empty", cursor: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(testCursorKey, tt.cursor); err != errInvalidCursor {
+				t.Errorf("got error %v, want %v", err, errInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestValidateCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		valid   bool
+	}{
+		{name: "first page", filters: Filters{Sort: "year", UseCursor: true}, valid: true},
+		{name: "same sort", filters: Filters{Sort: "year", UseCursor: true, Cursor: encodeCursor(testCursorKey, cursor{Sort: "year", Value: "2001", ID: 7})}, valid: true},
+		{name: "other sort", filters: Filters{Sort: "-year", UseCursor: true, Cursor: encodeCursor(testCursorKey, cursor{Sort: "year", Value: "2001", ID: 7})}},
+		{name: "forged", filters: Filters{Sort: "year", UseCursor: true, Cursor: encodeCursor([]byte("another key"), cursor{Sort: "year", Value: "2001", ID: 7})}},
+		{name: "offset pagination", filters: Filters{Sort: "year", Cursor: "ignored"}, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			validateCursor(v, testCursorKey, tt.filters)
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t, want %t: %v", v.Valid(), tt.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// Identity links a user to their account with an external identity provider, which is
+// identified by the issuer and subject of the provider's ID tokens.
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+}
+
+type IdentityModel struct {
+	DB DBTX
+}
+
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	args := []interface{}{identity.UserID, identity.Issuer, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt); err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_issuer_subject_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetUser returns the user that the identity with the given issuer and subject is linked to.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.pending_email, users.locked_until, users.deletion_scheduled_at
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	if err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.LockedUntil,
+		&user.DeletionScheduledAt,
+	); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m IdentityModel) GetAllForUser(userID int64) ([]*Identity, error) {
+	query := `
+		SELECT id, user_id, created_at, issuer, subject, email
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+		if err := rows.Scan(&identity.ID, &identity.UserID, &identity.CreatedAt, &identity.Issuer, &identity.Subject, &identity.Email); err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// OIDCLogin is what has to be remembered about a login while the user is away at the
+// identity provider. It is looked up by the state the provider hands back, which is only
+// stored hashed.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+type OIDCLoginModel struct {
+	DB DBTX
+}
+
+func (m OIDCLoginModel) Insert(login *OIDCLogin) error {
+	query := `
+		INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4)`
+
+	stateHash := sha256.Sum256([]byte(login.State))
+	args := []interface{}{stateHash[:], login.Nonce, login.CodeVerifier, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume returns the unexpired login with the given state and deletes it, so that each
+// login can only be completed once.
+func (m OIDCLoginModel) Consume(state string) (*OIDCLogin, error) {
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING nonce, code_verifier, expiry`
+
+	stateHash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	login := OIDCLogin{State: state}
+	if err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if login.Expiry.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// DeleteExpired removes logins that were never completed.
+func (m OIDCLoginModel) DeleteExpired() error {
+	query := `
+		DELETE FROM oidc_logins
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
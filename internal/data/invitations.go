@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+// Invitation lets someone register while registration is otherwise restricted. It can only
+// be redeemed for the email address it was sent to, and the new user is pre-activated and
+// granted the invitation's permissions.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	CreatedBy   *int64      `json:"created_by"` // nil if the admin has since been deleted
+	Email       string      `json:"email"`
+	Plaintext   string      `json:"-"` // Only set when the invitation is created, and only ever emailed
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      time.Time   `json:"expiry"`
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(invitation.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+}
+
+type InvitationModel struct {
+	DB DBTX
+}
+
+// New generates the invitation's token and stores it, replacing any earlier invitations
+// for the same email address. The returned invitation is the only one that will ever have
+// its Plaintext set.
+func (m InvitationModel) New(invitation *Invitation, ttl time.Duration) error {
+	token, err := generateToken(0, ttl, "")
+	if err != nil {
+		return err
+	}
+
+	invitation.Plaintext = token.Plaintext
+	invitation.Hash = token.Hash
+	invitation.Expiry = token.Expiry
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE email = $1`, invitation.Email); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO invitations (created_by, email, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{invitation.CreatedBy, invitation.Email, invitation.Hash, pq.Array(invitation.Permissions), invitation.Expiry}
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m InvitationModel) GetAll(filters Filters) ([]*Invitation, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, created_by, email, permissions, expiry
+		FROM invitations
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+		err := rows.Scan(
+			&totalRecords,
+			&invitation.ID,
+			&invitation.CreatedAt,
+			&invitation.CreatedBy,
+			&invitation.Email,
+			pq.Array(&invitation.Permissions),
+			&invitation.Expiry,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return invitations, metadata, nil
+}
+
+// Consume returns the unexpired invitation with the given token for email and deletes it,
+// so that it can only be redeemed once.
+func (m InvitationModel) Consume(plaintext, email string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM invitations
+		WHERE hash = $1 AND email = $2 AND expiry > $3
+		RETURNING id, created_at, created_by, email, permissions, expiry`
+
+	return m.deleteReturning(query, hash[:], email, time.Now())
+}
+
+// ConsumeForEmail is like Consume, but for whoever can show they own email some other way
+// than with the token, e.g. by logging in through an identity provider that verified it.
+func (m InvitationModel) ConsumeForEmail(email string) (*Invitation, error) {
+	query := `
+		DELETE FROM invitations
+		WHERE email = $1 AND expiry > $2
+		RETURNING id, created_at, created_by, email, permissions, expiry`
+
+	return m.deleteReturning(query, email, time.Now())
+}
+
+// deleteReturning runs a DELETE query that returns the deleted invitation.
+func (m InvitationModel) deleteReturning(query string, args ...any) (*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invitation Invitation
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.CreatedBy,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+		&invitation.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+func (m InvitationModel) Delete(id int64) (*Invitation, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM invitations
+		WHERE id = $1
+		RETURNING id, created_at, created_by, email, permissions, expiry`
+
+	return m.deleteReturning(query, id)
+}
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// LoginFailureStats summarises the recent failed logins for an email address and for the
+// IP address a login is being attempted from.
+type LoginFailureStats struct {
+	EmailCount       int
+	LastEmailFailure *time.Time
+	IPCount          int
+	LastIPFailure    *time.Time
+}
+
+type LoginFailureModel struct {
+	DB DBTX
+}
+
+func (m LoginFailureModel) Insert(email, ip string) error {
+	query := `
+		INSERT INTO login_failures (email, ip)
+		VALUES ($1, $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, ip)
+	return err
+}
+
+// GetStats counts the failures for email and for ip since the given time.
+func (m LoginFailureModel) GetStats(email, ip string, since time.Time) (LoginFailureStats, error) {
+	query := `
+		SELECT
+			count(*) FILTER (WHERE email = $1), max(created_at) FILTER (WHERE email = $1),
+			count(*) FILTER (WHERE ip = $2), max(created_at) FILTER (WHERE ip = $2)
+		FROM login_failures
+		WHERE created_at > $3 AND (email = $1 OR ip = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stats LoginFailureStats
+	err := m.DB.QueryRowContext(ctx, query, email, ip, since).Scan(
+		&stats.EmailCount,
+		&stats.LastEmailFailure,
+		&stats.IPCount,
+		&stats.LastIPFailure,
+	)
+
+	return stats, err
+}
+
+// DeleteForEmail clears the failures for email, after a successful login or once the
+// account has been locked.
+func (m LoginFailureModel) DeleteForEmail(email string) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// DeleteOlderThan removes failures that no longer count towards any limit.
+func (m LoginFailureModel) DeleteOlderThan(before time.Time) error {
+	query := `
+		DELETE FROM login_failures
+		WHERE created_at <= $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, before)
+	return err
+}
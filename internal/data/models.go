@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -11,17 +13,120 @@ var (
 )
 
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	Roles         RoleModel
+	Denylist      DenylistModel
+	APIKeys       APIKeyModel
+	TOTP          TOTPModel
+	LoginFailures LoginFailureModel
+	Audit         AuditModel
+	Identities    IdentityModel
+	OIDCLogins    OIDCLoginModel
+	Invitations   InvitationModel
+
+	db              DBTX
+	permissionCache *PermissionCache
+	cursorKey       []byte
+}
+
+// DBTX is implemented by both *sql.DB and *sql.Tx, so that the same models can run their
+// queries either directly or as part of a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type tx interface {
+	DBTX
+	Commit() error
+	Rollback() error
+}
+
+// joinedTx is a transaction started by someone else, which they are responsible for
+// committing or rolling back.
+type joinedTx struct {
+	*sql.Tx
 }
 
-func NewModels(db *sql.DB) Models {
+func (joinedTx) Commit() error   { return nil }
+func (joinedTx) Rollback() error { return nil }
+
+// beginTx starts a transaction for a model method that needs several statements to succeed
+// or fail together. If the model is already bound to a transaction, the statements become
+// part of it instead.
+func beginTx(ctx context.Context, db DBTX) (tx, error) {
+	switch db := db.(type) {
+	case *sql.DB:
+		return db.BeginTx(ctx, nil)
+	case *sql.Tx:
+		return joinedTx{db}, nil
+	default:
+		return nil, errors.New("data: can't start a transaction")
+	}
+}
+
+// NewModels returns the models backed by db. permissionCache may be nil to always read
+// permissions from the database. cursorKey signs the cursors for paging through movies.
+func NewModels(db DBTX, permissionCache *PermissionCache, cursorKey []byte) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db, CursorKey: cursorKey},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db, Cache: permissionCache},
+		Roles:         RoleModel{DB: db, Cache: permissionCache},
+		Denylist:      DenylistModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		OIDCLogins:    OIDCLoginModel{DB: db},
+		Invitations:   InvitationModel{DB: db},
+
+		db:              db,
+		permissionCache: permissionCache,
+		cursorKey:       cursorKey,
+	}
+}
+
+// Transaction calls fn with a copy of the models that run all their queries in a single
+// transaction, which is committed if fn returns nil and rolled back otherwise. Permissions
+// changed by fn are only dropped from the cache once the transaction has committed. If the
+// models are already bound to a transaction fn simply runs in that one.
+func (m Models) Transaction(fn func(Models) error) error {
+	db, ok := m.db.(*sql.DB)
+	if !ok {
+		return fn(m)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pending := &invalidations{cache: m.permissionCache}
+
+	models := NewModels(tx, m.permissionCache, m.cursorKey)
+	models.Permissions.pending = pending
+	models.Roles.pending = pending
+
+	if err := fn(models); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	pending.apply()
+
+	return nil
 }
@@ -5,6 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -12,13 +16,44 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`                // Unique identifier for the movie
-	CreatedAt time.Time `json:"-"`                 // Time when the movie was added to our db
-	Title     string    `json:"title"`             // The title of the movie
-	Year      int32     `json:"year,omitempty"`    // The release year of the movie
-	Runtime   Runtime   `json:"runtime,omitempty"` // The runtime of the movie in minutes
-	Genres    []string  `json:"genres,omitempty"`  // The genres of the movie
-	Version   int32     `json:"version"`           // The version of the movie: starts at 1 and increments each time the movie is updated
+	ID        int64     `json:"id"`                  // Unique identifier for the movie
+	CreatedAt time.Time `json:"-"`                   // Time when the movie was added to our db
+	Title     string    `json:"title"`               // The title of the movie
+	Year      int32     `json:"year,omitempty"`      // The release year of the movie
+	Runtime   Runtime   `json:"runtime,omitempty"`   // The runtime of the movie in minutes
+	Genres    []string  `json:"genres,omitempty"`    // The genres of the movie
+	Version   int32     `json:"version"`             // The version of the movie: starts at 1 and increments each time the movie is updated
+	CreatedBy *int64    `json:"created_by"`          // The ID of the user who added the movie, if known and they still exist
+	Headline  string    `json:"headline,omitempty"`  // The title with the words matching the search highlighted, only set when searching
+	Relevance float64   `json:"relevance,omitempty"` // How well the movie matches the search, only set when searching
+}
+
+// MovieSuggestion is a movie suggested by autocompletion, with just enough to show it.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// sortValue returns the movie's value for a sort column, as text for a cursor. Postgres
+// converts it back to the column's type when it is compared with the column.
+func (m *Movie) sortValue(column string) string {
+	switch column {
+	case "id":
+		return strconv.FormatInt(m.ID, 10)
+	case "title":
+		return m.Title
+	case "year":
+		return strconv.FormatInt(int64(m.Year), 10)
+	case "runtime":
+		return strconv.FormatInt(int64(m.Runtime), 10)
+	default:
+		panic("no sort value for column: " + column)
+	}
+}
+
+// IsOwnedBy reports whether the user added the movie.
+func (m *Movie) IsOwnedBy(userID int64) bool {
+	return m.CreatedBy != nil && *m.CreatedBy == userID
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -39,16 +74,19 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
+	// Signs pagination cursors. Unless every instance uses the same key, a cursor only works
+	// with the instance that returned it.
+	CursorKey []byte
 }
 
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, created_by)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -64,7 +102,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, version, created_by
 		FROM movies
 		WHERE id = $1`
 
@@ -81,6 +119,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.CreatedBy,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -149,25 +188,435 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+// GetAllCreatedBy returns every movie the user added.
+func (m MovieModel) GetAllCreatedBy(userID int64) ([]*Movie, error) {
+	query := `
+		SELECT 0, ` + movieColumns + `, '', 0
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres && $2 OR $2 = '{}')
+		WHERE created_by = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	movies, _, err := m.query(ctx, query, userID)
+	return movies, err
+}
+
+// MovieFilters narrows down the movies returned by GetAll. Zero values match anything.
+type MovieFilters struct {
+	Title string
+	// Fuzzy matches Title by trigram similarity rather than by whole words, which tolerates
+	// typos. Matching movies are ranked by how similar their titles are.
+	Fuzzy  bool
+	Genres []string
+	// GenresMode is how Genres are matched: movies must have "all" of them, "any" of them,
+	// or "none" of them.
+	GenresMode    string
+	YearMin       int
+	YearMax       int
+	RuntimeMin    int
+	RuntimeMax    int
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	IDs           []int64
+	// Search is a web search style query, with quoted phrases, "or" and -excluded words,
+	// matched against the stemmed title. Words also match as prefixes, so partial words hit.
+	Search string
+}
+
+func ValidateMovieFilters(v *validator.Validator, f MovieFilters) {
+	v.Check(len(f.Search) <= 200, "search", "must not be more than 200 bytes long")
+	v.Check(!f.Fuzzy || f.Title != "", "title", "must be provided for a fuzzy search")
+	// Both rank the results, and there is only one relevance to rank them by.
+	v.Check(!f.Fuzzy || f.Search == "", "fuzzy", "can't be used with search")
+
+	v.Check(f.GenresMode == "" || validator.PermittedValue(f.GenresMode, "all", "any", "none"), "genres_mode", "must be all, any or none")
+
+	// The same ranges as ValidateMovie, which also keeps the values within the columns' types.
+	currentYear := time.Now().Year()
+	v.Check(f.YearMin == 0 || (f.YearMin >= 1888 && f.YearMin <= currentYear), "year_min", fmt.Sprintf("must be between 1888 and %d", currentYear))
+	v.Check(f.YearMax == 0 || (f.YearMax >= 1888 && f.YearMax <= currentYear), "year_max", fmt.Sprintf("must be between 1888 and %d", currentYear))
+	v.Check(f.YearMin == 0 || f.YearMax == 0 || f.YearMin <= f.YearMax, "year_max", "must not be less than year_min")
+
+	v.Check(f.RuntimeMin == 0 || (f.RuntimeMin > 0 && f.RuntimeMin <= math.MaxInt32), "runtime_min", fmt.Sprintf("must be between 1 and %d", math.MaxInt32))
+	v.Check(f.RuntimeMax == 0 || (f.RuntimeMax > 0 && f.RuntimeMax <= math.MaxInt32), "runtime_max", fmt.Sprintf("must be between 1 and %d", math.MaxInt32))
+	v.Check(f.RuntimeMin == 0 || f.RuntimeMax == 0 || f.RuntimeMin <= f.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+
+	v.Check(f.CreatedAfter == nil || f.CreatedBefore == nil || f.CreatedAfter.Before(*f.CreatedBefore), "created_before", "must be after created_after")
+
+	v.Check(len(f.IDs) <= 100, "ids", "must not contain more than 100 ids")
+	v.Check(validator.Unique(f.IDs), "ids", "must not contain duplicate values")
+	for _, id := range f.IDs {
+		v.Check(id > 0, "ids", "must only contain positive integers")
+	}
+}
+
+// movieColumns are the columns that query scans after the count. They are followed by the
+// headline and relevance, which are only meaningful when searching.
+const movieColumns = "id, created_at, title, year, runtime, genres, version, created_by"
+
+// movieSelection is what a GetAll query selects from and which expressions give the search
+// headline and relevance.
+type movieSelection struct {
+	from      string
+	where     string
+	headline  string
+	relevance string
+}
+
+// selection returns what a query for the movies matching f selects from and the conditions
+// they have to meet, adding the values to args.
+func (f MovieFilters) selection(args *queryArgs) movieSelection {
+	sel := movieSelection{from: "movies", headline: "''", relevance: "0"}
+
+	var conditions []string
+
+	switch {
+	case f.Fuzzy:
+		// <% is true when the title has a part that is similar enough to the whole of the
+		// search, so that a misspelt word still finds longer titles that contain it.
+		title := args.add(f.Title)
+		sel.relevance = fmt.Sprintf("word_similarity(%s, title)", title)
+		conditions = append(conditions, fmt.Sprintf("%s <%% title", title))
+	case f.Title != "":
+		conditions = append(conditions, fmt.Sprintf("to_tsvector('simple', title) @@ plainto_tsquery('simple', %s)", args.add(f.Title)))
+	}
+
+	if len(f.Genres) > 0 {
+		genres := args.add(pq.Array(f.Genres))
+
+		switch f.GenresMode {
+		case "all":
+			conditions = append(conditions, "genres @> "+genres)
+		case "none":
+			conditions = append(conditions, "NOT genres && "+genres)
+		default:
+			conditions = append(conditions, "genres && "+genres)
+		}
+	}
+
+	if f.YearMin != 0 {
+		conditions = append(conditions, "year >= "+args.add(f.YearMin))
+	}
+
+	if f.YearMax != 0 {
+		conditions = append(conditions, "year <= "+args.add(f.YearMax))
+	}
+
+	if f.RuntimeMin != 0 {
+		conditions = append(conditions, "runtime >= "+args.add(f.RuntimeMin))
+	}
+
+	if f.RuntimeMax != 0 {
+		conditions = append(conditions, "runtime <= "+args.add(f.RuntimeMax))
+	}
+
+	if f.CreatedAfter != nil {
+		conditions = append(conditions, "created_at > "+args.add(*f.CreatedAfter))
+	}
+
+	if f.CreatedBefore != nil {
+		conditions = append(conditions, "created_at < "+args.add(*f.CreatedBefore))
+	}
+
+	if len(f.IDs) > 0 {
+		conditions = append(conditions, fmt.Sprintf("id = ANY(%s)", args.add(pq.Array(f.IDs))))
+	}
+
+	if f.Search != "" {
+		sel.from += fmt.Sprintf(", (SELECT %s AS query) AS search", prefixTSQuery(args.add(f.Search)))
+		sel.headline = "ts_headline('english', title, search.query)"
+		sel.relevance = "ts_rank_cd(to_tsvector('english', title), search.query)"
+		conditions = append(conditions, "to_tsvector('english', title) @@ search.query")
+	}
+
+	if len(conditions) > 0 {
+		sel.where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return sel
+}
+
+func (m MovieModel) GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error) {
+	var args queryArgs
+
+	sel := movieFilters.selection(&args)
+
+	if filters.UseCursor {
+		return m.getAllByCursor(sel, args, filters)
+	}
+
+	// The total comes for free with the results, but counting every matching row still
+	// costs a scan of them all.
+	total := "count(*) OVER()"
+	if filters.OmitTotal {
+		total = "0"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s, %s, %s AS headline, %s AS relevance
+		FROM %s
+		%s
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT %s OFFSET %s`,
+		total, movieColumns, sel.headline, sel.relevance, sel.from, sel.where,
+		filters.sortColumn(), filters.sortDirection(), args.add(filters.limit()), args.add(filters.offset()))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	movies, totalRecords, err := m.query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
 
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if filters.OmitTotal {
+		return movies, Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}, nil
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+// The facets that can be counted for a movie listing.
+const (
+	FacetGenres        = "genres"
+	FacetDecade        = "decade"
+	FacetRuntimeBucket = "runtime_bucket"
+)
+
+var MovieFacets = []string{FacetGenres, FacetDecade, FacetRuntimeBucket}
+
+// FacetCount is how many movies have a value for a facet.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// runtimeBucket groups runtimes for the runtime_bucket facet. The labels can be turned back
+// into runtime_min and runtime_max filters.
+const runtimeBucket = `CASE WHEN runtime < 90 THEN '0-89' WHEN runtime < 120 THEN '90-119' WHEN runtime < 150 THEN '120-149' ELSE '150+' END`
+
+// GetFacets counts the movies matching movieFilters by each of the facets. Each facet's
+// counts leave out the facet's own filter, so that they show how many movies there would be
+// if that filter was changed rather than just repeating it.
+func (m MovieModel) GetFacets(movieFilters MovieFilters, facets []string) (map[string][]*FacetCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	counts := make(map[string][]*FacetCount, len(facets))
+
+	for _, facet := range facets {
+		f := movieFilters
+
+		var value, from, order string
+
+		switch facet {
+		case FacetGenres:
+			f.Genres, f.GenresMode = nil, ""
+			value, from, order = "genre", ", unnest(genres) AS genre", "count(*) DESC, value"
+		case FacetDecade:
+			f.YearMin, f.YearMax = 0, 0
+			value, order = "(year / 10 * 10)::text", "min(year)"
+		case FacetRuntimeBucket:
+			f.RuntimeMin, f.RuntimeMax = 0, 0
+			value, order = runtimeBucket, "min(runtime)"
+		default:
+			panic("unknown movie facet: " + facet)
+		}
+
+		var args queryArgs
+		sel := f.selection(&args)
+
+		query := fmt.Sprintf(`
+			SELECT %s AS value, count(*)
+			FROM %s%s
+			%s
+			GROUP BY value
+			ORDER BY %s`, value, sel.from, from, sel.where, order)
+
+		rows, err := m.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[facet], err = scanFacetCounts(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+func scanFacetCounts(rows *sql.Rows) ([]*FacetCount, error) {
+	defer rows.Close()
+
+	counts := []*FacetCount{}
+
+	for rows.Next() {
+		var count FacetCount
+		if err := rows.Scan(&count.Value, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, &count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// Autocomplete returns up to limit movies whose titles could be what someone typing q is
+// looking for. Titles that start with q come first, then those most similar to it, so that
+// a typo doesn't leave the suggestions empty.
+func (m MovieModel) Autocomplete(q string, limit int) ([]*MovieSuggestion, error) {
+	query := `
+		SELECT id, title
+		FROM movies
+		WHERE title ILIKE $1 || '%' OR $2 <% title
+		ORDER BY title ILIKE $1 || '%' DESC, word_similarity($2, title) DESC, title, id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, likeEscaper.Replace(q), q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*MovieSuggestion{}
+
+	for rows.Next() {
+		var suggestion MovieSuggestion
+		if err := rows.Scan(&suggestion.ID, &suggestion.Title); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// likeEscaper escapes the characters that are special in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// prefixTSQuery returns the SQL for the tsquery of the search in param, with every lexeme
+// also matching as a prefix so that results show up while the last word is still being
+// typed. websearch_to_tsquery can't do that by itself, so :* is added to each quoted lexeme
+// in the text form of its query before casting it back.
+func prefixTSQuery(param string) string {
+	return fmt.Sprintf(`regexp_replace(websearch_to_tsquery('english', %s)::text, '''((?:[^'']|'''')+)''', '''\1'':*', 'g')::tsquery`, param)
+}
+
+// ValidateCursor checks that the cursor in filters, if any, was returned by GetAll for the
+// same sort.
+func (m MovieModel) ValidateCursor(v *validator.Validator, filters Filters) {
+	validateCursor(v, m.CursorKey, filters)
+}
+
+// getAllByCursor is GetAll for keyset pagination. One more row than the page size is read
+// to find out whether there is another page after this one.
+func (m MovieModel) getAllByCursor(sel movieSelection, args queryArgs, filters Filters) ([]*Movie, Metadata, error) {
+	var c cursor
+	if filters.Cursor != "" {
+		var err error
+		if c, err = decodeCursor(m.CursorKey, filters.Cursor); err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	metadata := Metadata{PageSize: filters.PageSize}
+
+	// The count has to leave out the cursor's condition, so it can't be a window function
+	// over the page.
+	if !filters.OmitTotal {
+		query := fmt.Sprintf("SELECT count(*) FROM %s %s", sel.from, sel.where)
+
+		if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&metadata.TotalRecords); err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	where := sel.where
+
+	if filters.Cursor != "" {
+		keyset := filters.keysetCondition(c, &args)
+
+		if where == "" {
+			where = "WHERE " + keyset
+		} else {
+			where += " AND " + keyset
+		}
+	}
+
+	query := fmt.Sprintf(`
+		SELECT 0, %s, %s AS headline, %s AS relevance
+		FROM %s
+		%s
+		ORDER BY %s
+		LIMIT %s`,
+		movieColumns, sel.headline, sel.relevance, sel.from, where, filters.keysetOrder(c), args.add(filters.limit()+1))
+
+	movies, _, err := m.query(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 
+	more := len(movies) > filters.limit()
+	if more {
+		movies = movies[:filters.limit()]
+	}
+
+	if c.Backward {
+		slices.Reverse(movies)
+	}
+
+	if len(movies) == 0 {
+		return movies, metadata, nil
+	}
+
+	column := filters.sortColumn()
+	first, last := movies[0], movies[len(movies)-1]
+
+	// Going forward there are more rows after this page if the extra one was found, and rows
+	// before it if there was a cursor at all. Going backward it's the other way around.
+	hasNext, hasPrev := more, filters.Cursor != ""
+	if c.Backward {
+		hasNext, hasPrev = true, more
+	}
+
+	if hasNext {
+		metadata.NextCursor = encodeCursor(m.CursorKey, cursor{Sort: filters.Sort, Value: last.sortValue(column), ID: last.ID})
+	}
+
+	if hasPrev {
+		metadata.PrevCursor = encodeCursor(m.CursorKey, cursor{Sort: filters.Sort, Value: first.sortValue(column), ID: first.ID, Backward: true})
+	}
+
+	return movies, metadata, nil
+}
+
+// query runs a query for movies that selects a count, movieColumns, the headline and the
+// relevance, in that order.
+func (m MovieModel) query(ctx context.Context, query string, args ...any) ([]*Movie, int, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
 
 	totalRecords := 0
@@ -184,19 +633,20 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
+			&movie.Headline,
+			&movie.Relevance,
 		)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, 0, err
 		}
 
 		movies = append(movies, &movie)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, 0, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
-
-	return movies, metadata, nil
+	return movies, totalRecords, nil
 }
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nighon/greenlight/internal/breached"
+	"github.com/nighon/greenlight/internal/validator"
+)
+
+// PasswordPolicy is applied to every new password, on top of the length limits in
+// ValidatePasswordPlaintext.
+type PasswordPolicy struct {
+	// Minimum estimated entropy in bits, see validator.Entropy. Zero disables the check.
+	MinEntropy float64
+	// Passwords known to have been leaked in data breaches. Nil disables the check.
+	Breached *breached.Corpus
+}
+
+// Validate checks a new password for the user against the policy. An error is only returned
+// if the password couldn't be checked, which isn't a problem with the password itself.
+func (p PasswordPolicy) Validate(v *validator.Validator, password string, user *User) error {
+	if p.MinEntropy > 0 {
+		v.Check(validator.Entropy(password) >= p.MinEntropy, "password", "is too easy to guess, try a longer password or one with a wider mix of characters")
+	}
+
+	v.Check(!containsPersonalInfo(password, user), "password", "must not contain your name or email address")
+
+	if p.Breached != nil && v.Valid() {
+		found, err := p.Breached.Contains(password)
+		if err != nil {
+			return fmt.Errorf("checking breached passwords: %w", err)
+		}
+		v.Check(!found, "password", "has appeared in a data breach and must not be used")
+	}
+
+	return nil
+}
+
+// containsPersonalInfo reports whether the password contains the user's name, any word of
+// it, or their email address or its local part. Very short parts are ignored, as they would
+// rule out too many unrelated passwords.
+func containsPersonalInfo(password string, user *User) bool {
+	password = strings.ToLower(password)
+
+	localPart, _, _ := strings.Cut(user.Email, "@")
+
+	parts := append(strings.Fields(user.Name), user.Name, user.Email, localPart)
+	for _, part := range parts {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PermissionsChannel is the Postgres notification channel that the ID of a user is sent on
+// whenever their permissions change, so that every instance can drop its cached copy. A
+// payload of "*" drops every cached copy, e.g. after the permissions of a role are changed:
+//
+//	NOTIFY permissions_changed, '*';
+const PermissionsChannel = "permissions_changed"
+
+// PermissionCache is a least recently used cache of each user's effective permissions. Entries
+// also expire after a TTL, which bounds how stale they can get if a change notification is
+// ever missed.
+type PermissionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[int64]*list.Element
+	order   *list.List // Most recently used at the front
+	// Incremented on every invalidation, so that a lookup which started before one can tell
+	// that the permissions it read may already be out of date.
+	generation uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	userID      int64
+	permissions Permissions
+	expiry      time.Time
+}
+
+func NewPermissionCache(ttl time.Duration, size int) *PermissionCache {
+	return &PermissionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[int64]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached permissions for the user if there are any, along with the current
+// generation to pass to set.
+func (c *PermissionCache) get(userID int64) (Permissions, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[userID]; ok {
+		entry := element.Value.(*permissionCacheEntry)
+		if time.Now().Before(entry.expiry) {
+			c.order.MoveToFront(element)
+			c.hits.Add(1)
+			return entry.permissions, c.generation, true
+		}
+
+		c.remove(element)
+	}
+
+	c.misses.Add(1)
+	return nil, c.generation, false
+}
+
+// set caches the permissions read for the user, unless anything has been invalidated since
+// generation was returned by get.
+func (c *PermissionCache) set(userID int64, permissions Permissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[userID]; ok {
+		c.remove(element)
+	}
+
+	c.entries[userID] = c.order.PushFront(&permissionCacheEntry{
+		userID:      userID,
+		permissions: permissions,
+		expiry:      time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *PermissionCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*permissionCacheEntry).userID)
+}
+
+// Invalidate drops the cached permissions for the user.
+func (c *PermissionCache) Invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if element, ok := c.entries[userID]; ok {
+		c.remove(element)
+	}
+}
+
+// InvalidateAll empties the cache, e.g. when a role changes or notifications may have been
+// missed.
+func (c *PermissionCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[int64]*list.Element)
+	c.order.Init()
+}
+
+// invalidations collects the users whose permissions were changed in a transaction. They are
+// only dropped from the cache with apply, once the transaction has committed, since otherwise
+// a concurrent read could cache the old permissions again before the change is visible.
+type invalidations struct {
+	cache   *PermissionCache
+	userIDs []int64
+}
+
+func (i *invalidations) add(userID int64) {
+	i.userIDs = append(i.userIDs, userID)
+}
+
+func (i *invalidations) apply() {
+	if i.cache == nil {
+		return
+	}
+
+	for _, userID := range i.userIDs {
+		i.cache.Invalidate(userID)
+	}
+}
+
+// invalidate drops the user's cached permissions, or adds them to pending if the change was
+// made in a transaction that has yet to commit.
+func invalidate(cache *PermissionCache, pending *invalidations, userID int64) {
+	switch {
+	case pending != nil:
+		pending.add(userID)
+	case cache != nil:
+		cache.Invalidate(userID)
+	}
+}
+
+// Stats returns the number of cached users and the hit and miss counts, for publishing
+// through expvar.
+func (c *PermissionCache) Stats() map[string]int64 {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return map[string]int64{
+		"entries": int64(size),
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+	}
+}
@@ -0,0 +1,48 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInvalidationsHeldUntilApplied(t *testing.T) {
+	cache := NewPermissionCache(time.Minute, 10)
+
+	_, generation, _ := cache.get(1)
+	cache.set(1, Permissions{"movies:read"}, generation)
+
+	pending := &invalidations{cache: cache}
+	invalidate(cache, pending, 1)
+
+	if permissions, _, ok := cache.get(1); !ok || !slices.Equal(permissions, Permissions{"movies:read"}) {
+		t.Fatalf("before apply: got %v, %t, want the cached permissions", permissions, ok)
+	}
+
+	// A read that started before the commit mustn't be cached after it.
+	_, generation, _ = cache.get(2)
+
+	pending.apply()
+
+	if _, _, ok := cache.get(1); ok {
+		t.Error("after apply: permissions are still cached")
+	}
+
+	cache.set(2, Permissions{"movies:read"}, generation)
+	if _, _, ok := cache.get(2); ok {
+		t.Error("permissions read before apply were cached")
+	}
+}
+
+func TestInvalidateWithoutTransaction(t *testing.T) {
+	cache := NewPermissionCache(time.Minute, 10)
+
+	_, generation, _ := cache.get(1)
+	cache.set(1, Permissions{"movies:read"}, generation)
+
+	invalidate(cache, nil, 1)
+
+	if _, _, ok := cache.get(1); ok {
+		t.Error("permissions are still cached")
+	}
+}
@@ -2,7 +2,8 @@ package data
 
 import (
 	"context"
-	"database/sql"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -10,25 +11,64 @@ import (
 
 type Permissions []string
 
+// Include reports whether any of the permissions grants code. A permission ending in "*"
+// is a wildcard that grants every code starting with the rest of it, so "movies:*" grants
+// "movies:read" and "*" grants everything. Wildcards are matched the same way when code is
+// itself one, so "movies:*" is only granted by "movies:*" or "*".
 func (p Permissions) Include(code string) bool {
 	for _, permission := range p {
 		if permission == code {
 			return true
 		}
+		if prefix, ok := strings.CutSuffix(permission, "*"); ok && strings.HasPrefix(code, prefix) {
+			return true
+		}
 	}
 	return false
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB DBTX
+	// Optional. When set, GetAllForUser is served from it where possible, and it is
+	// invalidated whenever a user's permissions change.
+	Cache *PermissionCache
+	// Set by Models.Transaction, see invalidations.
+	pending *invalidations
 }
 
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if m.Cache == nil {
+		return m.getAllForUser(userID)
+	}
+
+	permissions, generation, ok := m.Cache.get(userID)
+	if ok {
+		return permissions, nil
+	}
+
+	permissions, err := m.getAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cache.set(userID, permissions, generation)
+
+	return permissions, nil
+}
+
+func (m PermissionModel) getAllForUser(userID int64) (Permissions, error) {
+	// A user's permissions are the ones granted to them directly plus the ones granted by
+	// each of their roles.
 	query := `
 		SELECT permissions.code FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users.id = users_permissions.user_id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
+		ORDER BY code
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -40,7 +80,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -61,11 +101,165 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes)); err != nil {
+		return err
+	}
+
+	return permissionsChanged(ctx, m.DB, m.Cache, m.pending, userID)
+}
+
+// GetAll returns every permission code that can be granted.
+func (m PermissionModel) GetAll() ([]string, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []string{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// GetDirectForUser returns the permissions granted to the user directly, leaving out those
+// that only come from their roles.
+func (m PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// RemoveForUser revokes a permission granted to the user directly. A permission the user
+// only has through one of their roles can't be revoked this way.
+func (m PermissionModel) RemoveForUser(userID int64, code string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1 AND permissions.code = $2
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	result, err := m.DB.ExecContext(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return permissionsChanged(ctx, m.DB, m.Cache, m.pending, userID)
+}
+
+// ReplaceForUser makes codes the user's complete set of direct permissions, in a single
+// transaction so the user never briefly holds neither the old nor the new set.
+func (m PermissionModel) ReplaceForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_permissions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	// Sent as part of the transaction, so other instances are only notified if it commits.
+	if err := permissionsChanged(ctx, tx, nil, nil, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// When the transaction was joined, it has yet to really commit.
+	invalidate(m.Cache, m.pending, userID)
+
+	return nil
+}
+
+// permissionsChanged invalidates the user's cached permissions, both in this instance's
+// cache and, through a notification, in every other instance's. Postgres only delivers the
+// notification once a transaction commits, and pending holds back the invalidation here
+// until then too.
+func permissionsChanged(ctx context.Context, db DBTX, cache *PermissionCache, pending *invalidations, userID int64) error {
+	if _, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, PermissionsChannel, strconv.FormatInt(userID, 10)); err != nil {
+		return err
+	}
+
+	invalidate(cache, pending, userID)
+
+	return nil
 }
@@ -0,0 +1,75 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nighon/greenlight/internal/testdb"
+)
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{name: "exact", permissions: Permissions{"movies:read"}, code: "movies:read", want: true},
+		{name: "one of several", permissions: Permissions{"users:read", "movies:write"}, code: "movies:write", want: true},
+		{name: "resource wildcard", permissions: Permissions{"movies:*"}, code: "movies:read", want: true},
+		{name: "resource wildcard grants itself", permissions: Permissions{"movies:*"}, code: "movies:*", want: true},
+		{name: "global wildcard", permissions: Permissions{"*"}, code: "users:manage", want: true},
+		{name: "global wildcard grants resource wildcard", permissions: Permissions{"*"}, code: "movies:*", want: true},
+		{name: "other action", permissions: Permissions{"movies:read"}, code: "movies:write"},
+		{name: "other resource wildcard", permissions: Permissions{"users:*"}, code: "movies:read"},
+		{name: "wildcard doesn't grant prefix of resource", permissions: Permissions{"movies:*"}, code: "movies"},
+		{name: "wildcard doesn't grant longer resource", permissions: Permissions{"movies:*"}, code: "moviesx:read"},
+		{name: "code isn't a wildcard for permissions", permissions: Permissions{"movies:read"}, code: "movies:*"},
+		{name: "code isn't a global wildcard", permissions: Permissions{"movies:read"}, code: "*"},
+		{name: "no permissions", permissions: nil, code: "movies:read"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.Include(tt.code); got != tt.want {
+				t.Errorf("%v.Include(%q): got %t, want %t", tt.permissions, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+// A read made while a transaction that changes the user's permissions is still open sees the
+// old permissions, and mustn't leave them cached once it commits.
+func TestPermissionCacheInvalidatedAfterCommit(t *testing.T) {
+	cache := NewPermissionCache(time.Minute, 10)
+	models := NewModels(testdb.New(t), cache, nil)
+
+	user := newTestUser(t, models.Users, "alice@example.com")
+
+	err := models.Transaction(func(m Models) error {
+		if err := m.Permissions.AddForUser(user.ID, "movies:write"); err != nil {
+			return err
+		}
+
+		permissions, err := models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			return err
+		}
+		if permissions.Include("movies:write") {
+			t.Error("uncommitted permission was read outside the transaction")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !permissions.Include("movies:write") {
+		t.Errorf("after commit: got %v, want movies:write included", permissions)
+	}
+}
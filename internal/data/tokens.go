@@ -6,22 +6,60 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"slices"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/nighon/greenlight/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeDeletionCancel = "deletion-cancel"
 )
 
+// ErrTokenReused is returned when a refresh token that has already been exchanged is
+// presented again, which means it has most likely been stolen.
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
+	ID        int64     `json:"-"`
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UserAgent string    `json:"-"` // User-Agent of the client the token was issued to
+	IP        string    `json:"-"` // IP address of the client the token was issued to
+	Family    string    `json:"-"` // Shared by all the tokens descended from one login
+}
+
+// Session is a login as shown to its owner: the chain of authentication and refresh tokens
+// issued since the user signed in. The plaintext and hash are never included.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"` // nil if the token has never been used
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"` // Whether the request was made with a token from this session
+}
+
+func generateFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -57,7 +95,7 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -70,12 +108,252 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewSession issues an authentication token and a refresh token for a new login. Both are
+// put in a new family, along with the client they were issued to so that the user can
+// later recognise the session. If accessTTL is zero only the refresh token is issued, for
+// callers that hand out their own (signed) authentication tokens.
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	family, err := generateFamily()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userID, accessTTL, refreshTTL, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// Refresh exchanges a refresh token for a new authentication and refresh token in the same
+// family. Each refresh token can only be exchanged once: if a used one is presented again,
+// the whole family is revoked and ErrTokenReused is returned. The returned tokens are for the
+// user the refresh token belongs to. As with NewSession, a zero accessTTL skips the
+// authentication token.
+func (m TokenModel) Refresh(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT user_id, family, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		FOR UPDATE
+	`
+	args := []interface{}{refreshHash[:], ScopeRefresh, time.Now()}
+
+	var (
+		userID int64
+		family string
+		usedAt *time.Time
+	)
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&userID, &family, &usedAt); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if usedAt != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family); err != nil {
+			return nil, nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrTokenReused
+	}
+
+	// Used refresh tokens are kept until they expire so that reuse can be detected, but
+	// the authentication tokens they replace are revoked straight away.
+	if _, err := tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, refreshHash[:]); err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE family = $1 AND scope = $2
+	`
+	if _, err := tx.ExecContext(ctx, query, family, ScopeAuthentication); err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userID, accessTTL, refreshTTL, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+func insertSessionTokens(ctx context.Context, tx DBTX, userID int64, accessTTL, refreshTTL time.Duration, family, userAgent, ip string) (*Token, *Token, error) {
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := []*Token{refresh}
+
+	var access *Token
+	if accessTTL > 0 {
+		access, err = generateToken(userID, accessTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokens = append(tokens, access)
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`
+
+	for _, token := range tokens {
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.Family = family
+
+		args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.Family}
+
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
+
+// GetSessionsForUser returns the user's active sessions, newest first. A session is
+// represented by its current refresh token, or by the authentication token itself for
+// tokens issued without one. currentTokenPlaintext is used to flag the session the request
+// was made from.
+func (m TokenModel) GetSessionsForUser(userID int64, currentTokenPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentTokenPlaintext))
+
+	query := `
+		SELECT t.id,
+			COALESCE((SELECT min(f.created_at) FROM tokens f WHERE f.family = t.family), t.created_at),
+			COALESCE((SELECT max(f.last_used_at) FROM tokens f WHERE f.family = t.family), t.last_used_at),
+			t.expiry, t.user_agent, t.ip,
+			t.hash = $4 OR COALESCE(t.family = (SELECT c.family FROM tokens c WHERE c.hash = $4), false)
+		FROM tokens t
+		WHERE t.user_id = $1 AND t.expiry > $5
+		AND ((t.scope = $2 AND t.used_at IS NULL) OR (t.scope = $3 AND t.family IS NULL))
+		ORDER BY 2 DESC, t.id DESC
+	`
+	args := []interface{}{userID, ScopeRefresh, ScopeAuthentication, currentHash[:], time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Touch records that a token has just been used. To avoid a write on every request, the
+// timestamp is only moved forward once it is more than a minute old.
+func (m TokenModel) Touch(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1 AND scope = $2
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+	args := []interface{}{tokenHash[:], scope}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteSession revokes the authentication token along with every other token in its family,
+// so that the session can't be resumed with its refresh token.
+func (m TokenModel) DeleteSession(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+		OR family = (SELECT family FROM tokens WHERE hash = $1 AND scope = $2)
 	`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{tokenHash[:], ScopeAuthentication}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -84,6 +362,108 @@ func (m TokenModel) Insert(token *Token) error {
 	return err
 }
 
+// DeleteFamily revokes every token descended from the same login.
+func (m TokenModel) DeleteFamily(family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// DeleteSessionForUser revokes one of the user's sessions by the ID returned from
+// GetSessionsForUser, returning its family as DeleteSessionsForUser does. It returns
+// ErrRecordNotFound if the user has no such session, including when it belongs to someone
+// else.
+func (m TokenModel) DeleteSessionForUser(id, userID int64) ([]string, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2 AND scope = ANY($3)
+		AND (id = $1 OR family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2))
+		RETURNING family
+	`
+	args := []interface{}{id, userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := false
+	families := []string{}
+	for rows.Next() {
+		deleted = true
+
+		var family sql.NullString
+		if err := rows.Scan(&family); err != nil {
+			return nil, err
+		}
+		if family.Valid && !slices.Contains(families, family.String) {
+			families = append(families, family.String)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !deleted {
+		return nil, ErrRecordNotFound
+	}
+
+	return families, nil
+}
+
+// DeleteSessionsForUser ends all of the user's sessions, returning the families they
+// belonged to so that any signed access tokens issued for them can be denied as well.
+func (m TokenModel) DeleteSessionsForUser(userID int64) ([]string, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3)
+		RETURNING family
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	families := []string{}
+	for rows.Next() {
+		// Tokens issued before sessions were introduced don't belong to a family.
+		var family sql.NullString
+		if err := rows.Scan(&family); err != nil {
+			return nil, err
+		}
+		if family.Valid && !slices.Contains(families, family.String) {
+			families = append(families, family.String)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
+
 func (m TokenModel) DeleteAllForUser(userID int64, scope string) error {
 	query := `
 		DELETE FROM tokens
@@ -5,10 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/nighon/greenlight/internal/passhash"
 	"github.com/nighon/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var ErrDuplicateEmail = errors.New("duplicate email")
@@ -23,6 +24,24 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// The address the user asked to change their email to. It only replaces Email once the
+	// user has confirmed it with the token sent to that address.
+	PendingEmail *string `json:"pending_email,omitempty"`
+	// Set while the user is locked out of logging in, e.g. after too many failed attempts.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// Set once the user has asked for their account to be deleted, to when it will be. Until
+	// then the deletion can be cancelled, but the user can't log in.
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+}
+
+// IsLocked reports whether the user is currently locked out of logging in.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(time.Now())
+}
+
+// IsPendingDeletion reports whether the user has asked for their account to be deleted.
+func (u *User) IsPendingDeletion() bool {
+	return u.DeletionScheduledAt != nil
 }
 
 func (u *User) IsAnonymous() bool {
@@ -34,42 +53,44 @@ type password struct {
 	hash      []byte
 }
 
+// passwordHasher is used for every password hash. Hashes describe the algorithm and
+// parameters they were produced with, so changing it doesn't invalidate existing hashes:
+// they are upgraded as users log in. The default matches the hashes stored before
+// argon2id was supported.
+var passwordHasher = passhash.New(passhash.Bcrypt{Cost: 12})
+
+// SetPasswordHasher replaces the hasher used for passwords. It should be called before any
+// passwords are set or checked.
+func SetPasswordHasher(h *passhash.Hasher) {
+	passwordHasher = h
+}
+
 // Set sets the password hash and plaintext
 func (p *password) Set(plaintextPassword string) error {
-	// Generates a bcrypt hash of a password using specific cost parameters (12 here)
-	// The higher the cost, the slower (more computationally expensive) the hash generation will be
-	// Need to strike a balance between security and performance
-	// Inputs are truncated to 72 bytes (bcrypt max) when creating the hash, so it's a good idea to
-	// e.g. enforce a hard max on the length of the password
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := passwordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
 
 	p.plaintext = &plaintextPassword
-	p.hash = hash
+	p.hash = []byte(hash)
 
 	return nil
 }
 
 // Checks if the provided plaintext password matches the hashed password
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	// Use the bcrypt package to compare the hashed password with the plaintext password
-	// Works by re-hashing the provided plaintext password (using same salt and cost) and comparing the result
-	// to the hashed password.
-	// Compares using subtle.ConstantTimeCompare to avoid timing attacks, which are side-channel
+	// The comparison is done in constant time to avoid timing attacks, which are side-channel
 	// attacks that allow an attacker to determine if the hashed password is correct by
 	// measuring the time taken to compare the hashed password.
-	if err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword)); err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return passwordHasher.Verify(plaintextPassword, string(p.hash))
+}
 
-	return true, nil
+// NeedsRehash reports whether the hash was produced by an algorithm, or with parameters,
+// other than the ones currently configured. The password should then be Set again the next
+// time the plaintext is known, i.e. after it Matches at login.
+func (p *password) NeedsRehash() bool {
+	return passwordHasher.NeedsRehash(string(p.hash))
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -79,7 +100,8 @@ func ValidateEmail(v *validator.Validator, email string) {
 
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	maxLength := passwordHasher.MaxPasswordLength()
+	v.Check(len(password) <= maxLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxLength))
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
 }
 
@@ -101,7 +123,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 func (m UserModel) Insert(user *User) error {
@@ -127,9 +149,99 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version, pending_email, locked_until, deletion_scheduled_at
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	if err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PendingEmail,
+		&user.LockedUntil,
+		&user.DeletionScheduledAt,
+	); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetAll returns a page of users whose name or email contains search, or all users if
+// search is empty.
+func (m UserModel) GetAll(search string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version, pending_email, locked_until, deletion_scheduled_at
+		FROM users
+		WHERE (name ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%' OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, likeEscaper.Replace(search), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.PendingEmail,
+			&user.LockedUntil,
+			&user.DeletionScheduledAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, version, pending_email, locked_until, deletion_scheduled_at
 		FROM users
 		WHERE email = $1`
 
@@ -145,6 +257,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.LockedUntil,
+		&user.DeletionScheduledAt,
 	); err != nil {
 		switch {
 		case err == sql.ErrNoRows:
@@ -160,11 +275,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, pending_email = $5, locked_until = $6, deletion_scheduled_at = $7,
+			version = version + 1
+		WHERE id = $8 AND version = $9
 		RETURNING version`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.PendingEmail, user.LockedUntil, user.DeletionScheduledAt, user.ID, user.Version}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -173,8 +289,9 @@ func (m UserModel) Update(user *User) error {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
+		// The version has changed since the user was read, or the user no longer exists.
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -183,11 +300,117 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// GetAllDueForDeletion returns the users whose scheduled deletion time has passed.
+func (m UserModel) GetAllDueForDeletion() ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version, pending_email, locked_until, deletion_scheduled_at
+		FROM users
+		WHERE deletion_scheduled_at <= NOW()
+		ORDER BY deletion_scheduled_at, id
+		LIMIT 100`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.PendingEmail,
+			&user.LockedUntil,
+			&user.DeletionScheduledAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Delete deletes the user along with everything that belongs to them. It returns
+// ErrEditConflict if the user has changed since they were read, e.g. because they have
+// cancelled their deletion in the meantime.
+func (m UserModel) Delete(user *User) error {
+	query := `
+		DELETE FROM users
+		WHERE id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, user.ID, user.Version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// SetLockedUntil locks the user out of logging in until the given time, or unlocks them if
+// it is nil. Unlike Update it doesn't need the current version, so it can't conflict with
+// other changes to the user.
+func (m UserModel) SetLockedUntil(userID int64, lockedUntil *time.Time) error {
+	query := `
+		UPDATE users
+		SET locked_until = $2, version = version + 1
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+			users.pending_email, users.locked_until, users.deletion_scheduled_at
 		FROM users
 		INNER JOIN tokens ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
@@ -210,6 +433,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PendingEmail,
+		&user.LockedUntil,
+		&user.DeletionScheduledAt,
 	); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -0,0 +1,60 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nighon/greenlight/internal/testdb"
+)
+
+func newTestUser(t *testing.T, m UserModel, email string) *User {
+	t.Helper()
+
+	user := &User{Name: "Alice Smith", Email: email}
+	if err := user.Password.Set("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestUserUpdateConflict(t *testing.T) {
+	m := UserModel{DB: testdb.New(t)}
+
+	user := newTestUser(t, m, "alice@example.com")
+
+	stale, err := m.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Activated = true
+	if err := m.Update(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read before the update above, so its version is out of date.
+	stale.Name = "Alice Jones"
+	if err := m.Update(stale); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("stale user: got error %v, want %v", err, ErrEditConflict)
+	}
+
+	current, err := m.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Name != "Alice Smith" || !current.Activated {
+		t.Errorf("got %q, activated %t, want the first update only", current.Name, current.Activated)
+	}
+
+	if err := m.Delete(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(current); !errors.Is(err, ErrEditConflict) {
+		t.Errorf("deleted user: got error %v, want %v", err, ErrEditConflict)
+	}
+}
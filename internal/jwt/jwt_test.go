@@ -0,0 +1,176 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+	Expiry  int64  `json:"exp"`
+}
+
+func newTestKey(t *testing.T, id, algorithm string, size int) *Key {
+	t.Helper()
+
+	material := strings.Repeat(id, size)[:size]
+	key, err := ParseKey(id + ":" + algorithm + ":" + base64.StdEncoding.EncodeToString([]byte(material)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKeyset(t *testing.T, keys ...*Key) *Keyset {
+	t.Helper()
+
+	ks, err := NewKeyset(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// resign returns token with its header replaced by h, signed with key.
+func resign(t *testing.T, token string, h header, key *Key) string {
+	t.Helper()
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := strings.Split(token, ".")[1]
+	signingInput := encoding.EncodeToString(b) + "." + payload
+	return signingInput + "." + encoding.EncodeToString(key.sign([]byte(signingInput)))
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		valid bool
+	}{
+		{name: "HS256", spec: "k1:HS256:" + base64.StdEncoding.EncodeToString(make([]byte, 32)), valid: true},
+		{name: "EdDSA", spec: "k1:EdDSA:" + base64.StdEncoding.EncodeToString(make([]byte, 32)), valid: true},
+		{name: "short HS256 secret", spec: "k1:HS256:" + base64.StdEncoding.EncodeToString(make([]byte, 31))},
+		{name: "wrong EdDSA seed size", spec: "k1:EdDSA:" + base64.StdEncoding.EncodeToString(make([]byte, 64))},
+		{name: "unsupported algorithm", spec: "k1:RS256:" + base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{name: "missing kid", spec: ":HS256:" + base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{name: "bad base64", spec: "k1:HS256:not base64"},
+		{name: "too few parts", spec: "k1:HS256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.spec)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		key  *Key
+	}{
+		{name: "HS256", key: newTestKey(t, "hmac", AlgorithmHS256, 32)},
+		{name: "EdDSA", key: newTestKey(t, "ed", AlgorithmEdDSA, 32)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := newTestKeyset(t, tt.key)
+
+			token, err := ks.Sign(testClaims{Subject: "42", Expiry: 1700000000})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !LooksLikeJWT(token) {
+				t.Errorf("%q doesn't look like a JWT", token)
+			}
+
+			var claims testClaims
+			if err := ks.Verify(token, &claims); err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "42" || claims.Expiry != 1700000000 {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	old := newTestKey(t, "old", AlgorithmHS256, 32)
+	current := newTestKey(t, "new", AlgorithmEdDSA, 32)
+
+	token, err := newTestKeyset(t, old).Sign(testClaims{Subject: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims testClaims
+	if err := newTestKeyset(t, current, old).Verify(token, &claims); err != nil {
+		t.Errorf("token signed with the old key: got error %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	hmacKey := newTestKey(t, "hmac", AlgorithmHS256, 32)
+	edKey := newTestKey(t, "ed", AlgorithmEdDSA, 32)
+	otherHMACKey := newTestKey(t, "hmac", AlgorithmHS256, 48)
+
+	ks := newTestKeyset(t, hmacKey, edKey)
+
+	token, err := ks.Sign(testClaims{Subject: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	tamperedPayload := encoding.EncodeToString([]byte(`{"sub":"1"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{name: "unknown kid", token: resign(t, token, header{Algorithm: AlgorithmHS256, Type: "JWT", KeyID: "other"}, hmacKey), want: ErrUnknownKey},
+		{name: "missing kid", token: resign(t, token, header{Algorithm: AlgorithmHS256, Type: "JWT"}, hmacKey), want: ErrUnknownKey},
+		{name: "wrong alg for kid", token: resign(t, token, header{Algorithm: AlgorithmEdDSA, Type: "JWT", KeyID: "hmac"}, edKey), want: ErrInvalidToken},
+		{name: "alg none", token: encoding.EncodeToString([]byte(`{"alg":"none","kid":"hmac"}`)) + "." + parts[1] + ".", want: ErrInvalidToken},
+		{name: "signed with another secret", token: resign(t, token, header{Algorithm: AlgorithmHS256, Type: "JWT", KeyID: "hmac"}, otherHMACKey), want: ErrInvalidToken},
+		{name: "tampered payload", token: parts[0] + "." + tamperedPayload + "." + parts[2], want: ErrInvalidToken},
+		{name: "tampered signature", token: parts[0] + "." + parts[1] + "." + encoding.EncodeToString(make([]byte, 32)), want: ErrInvalidToken},
+		{name: "missing signature", token: parts[0] + "." + parts[1] + ".", want: ErrInvalidToken},
+		{name: "two parts", token: parts[0] + "." + parts[1], want: ErrInvalidToken},
+		{name: "bad header encoding", token: "!." + parts[1] + "." + parts[2], want: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims testClaims
+			if err := ks.Verify(tt.token, &claims); !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewKeysetDuplicateID(t *testing.T) {
+	_, err := NewKeyset(newTestKey(t, "k1", AlgorithmHS256, 32), newTestKey(t, "k1", AlgorithmEdDSA, 32))
+	if err == nil {
+		t.Error("got no error")
+	}
+}
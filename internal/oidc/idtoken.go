@@ -0,0 +1,300 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ID tokens are accepted this far either side of their validity period, to allow for clocks
+// drifting apart.
+const clockSkew = time.Minute
+
+// Claims are the parts of a verified ID token that identify the user.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience may be a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+	return nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// VerifyIDToken checks the token's signature against the provider's published keys, and
+// that it was issued by the provider, to this client, for the login with the given nonce,
+// and hasn't expired.
+func (p *Provider) VerifyIDToken(ctx context.Context, token, nonce string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	// The algorithm has to be the one the key is for, whatever the header says.
+	if h.Algorithm != key.algorithm || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidIDToken)
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, fmt.Errorf("%w: wrong authorized party", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+type publicKey struct {
+	algorithm string
+	rsa       *rsa.PublicKey
+	ecdsa     *ecdsa.PublicKey
+}
+
+func (k publicKey) verify(signingInput, signature []byte) bool {
+	digest := sha256.Sum256(signingInput)
+
+	switch k.algorithm {
+	case "RS256":
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		// The signature is the two 32-byte integers r and s, rather than ASN.1.
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.ecdsa, digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+// key returns the provider's key with the given ID. The provider's keys are fetched again
+// when an unknown one is asked for, as that is how rotated keys are discovered, but no more
+// than once a minute so that made-up key IDs can't be used to hammer the provider. The lock
+// isn't held while fetching, so a slow provider only holds up the logins that need a new
+// key: they wait for the one fetch rather than each starting their own.
+func (p *Provider) key(ctx context.Context, id string) (publicKey, error) {
+	p.mu.Lock()
+
+	if key, ok := p.keys[id]; ok {
+		p.mu.Unlock()
+		return key, nil
+	}
+
+	if done := p.fetching; done != nil {
+		p.mu.Unlock()
+
+		select {
+		case <-done:
+			return p.cachedKey(id)
+		case <-ctx.Done():
+			return publicKey{}, ctx.Err()
+		}
+	}
+
+	if time.Since(p.keysFetchedAt) <= time.Minute {
+		p.mu.Unlock()
+		return publicKey{}, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, id)
+	}
+
+	done := make(chan struct{})
+	p.fetching = done
+	p.mu.Unlock()
+
+	keys, err := p.fetchKeys(ctx)
+
+	p.mu.Lock()
+	if err == nil {
+		p.keys = keys
+		p.keysFetchedAt = time.Now()
+	}
+	p.fetching = nil
+	close(done)
+	p.mu.Unlock()
+
+	if err != nil {
+		return publicKey{}, err
+	}
+
+	return p.cachedKey(id)
+}
+
+// cachedKey returns the key with the given ID from those already fetched.
+func (p *Provider) cachedKey(id string) (publicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return publicKey{}, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, id)
+	}
+
+	return key, nil
+}
+
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := getJSON(ctx, p.config.HTTPClient, p.jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetching keys: %w", err)
+	}
+
+	keys := make(map[string]publicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// Keys of other types or for other algorithms are skipped rather than rejected,
+		// since the provider may publish keys this package has no use for.
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[k.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (publicKey, error) {
+	switch {
+	case k.KeyType == "RSA" && (k.Algorithm == "" || k.Algorithm == "RS256"):
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return publicKey{}, fmt.Errorf("oidc: RSA exponent too large")
+		}
+		return publicKey{algorithm: "RS256", rsa: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+
+	case k.KeyType == "EC" && k.Curve == "P-256" && (k.Algorithm == "" || k.Algorithm == "ES256"):
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return publicKey{}, fmt.Errorf("oidc: EC point is not on the curve")
+		}
+		return publicKey{algorithm: "ES256", ecdsa: &ecdsa.PublicKey{Curve: curve, X: x, Y: y}}, nil
+
+	default:
+		return publicKey{}, fmt.Errorf("oidc: unsupported key type %q", k.KeyType)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
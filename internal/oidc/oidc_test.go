@@ -0,0 +1,476 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID    = "greenlight"
+	testRedirectURL = "https://greenlight.example.com/v1/oidc/callback"
+	testNonce       = "the-nonce"
+)
+
+// signingKey is a key the mock provider signs ID tokens with.
+type signingKey struct {
+	id        string
+	algorithm string
+	signer    crypto.Signer
+}
+
+func newRSAKey(t *testing.T, id string) signingKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{id: id, algorithm: "RS256", signer: key}
+}
+
+func newECKey(t *testing.T, id string) signingKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{id: id, algorithm: "ES256", signer: key}
+}
+
+func (k signingKey) jwk() map[string]string {
+	switch public := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"kid": k.id,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"kid": k.id,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32))),
+		}
+	default:
+		panic("unsupported key type")
+	}
+}
+
+// sign returns an ID token with the claims, signed by the key. The header's alg is the key's
+// unless alg is set.
+func (k signingKey) sign(t *testing.T, claims map[string]any, alg string) string {
+	t.Helper()
+
+	if alg == "" {
+		alg = k.algorithm
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": k.id, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// mockProvider is an identity provider serving discovery, JWKS and token endpoints.
+type mockProvider struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        []signingKey
+	jwksFetches int
+	idToken     string     // Returned by the token endpoint
+	tokenForm   url.Values // The last request to the token endpoint
+}
+
+func newMockProvider(t *testing.T, keys ...signingKey) *mockProvider {
+	t.Helper()
+
+	p := &mockProvider{keys: keys}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.jwksFetches++
+
+		set := struct {
+			Keys []map[string]string `json:"keys"`
+		}{}
+		for _, key := range p.keys {
+			set.Keys = append(set.Keys, key.jwk())
+		}
+
+		json.NewEncoder(w).Encode(set)
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.tokenForm = r.PostForm
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != testClientID || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		if r.PostForm.Get("code") != "the-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": p.idToken})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *mockProvider) fetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.jwksFetches
+}
+
+func (p *mockProvider) discover(t *testing.T) *Provider {
+	t.Helper()
+
+	provider, err := Discover(context.Background(), Config{
+		Issuer:       p.URL,
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+		HTTPClient:   p.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func (p *mockProvider) claims() map[string]any {
+	now := time.Now()
+
+	return map[string]any{
+		"iss":            p.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa")
+	ecKey := newECKey(t, "ec")
+
+	provider := newMockProvider(t, rsaKey, ecKey)
+
+	tests := []struct {
+		name    string
+		key     signingKey
+		alg     string // Overrides the header's alg
+		claims  func(map[string]any)
+		wantErr bool
+	}{
+		{name: "valid RS256", key: rsaKey},
+		{name: "valid ES256", key: ecKey},
+		{
+			name:   "several audiences with this client as authorized party",
+			key:    rsaKey,
+			claims: func(c map[string]any) { c["aud"] = []string{testClientID, "other"}; c["azp"] = testClientID },
+		},
+		{
+			name:    "wrong issuer",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["aud"] = "other" },
+			wantErr: true,
+		},
+		{
+			name:    "several audiences without authorized party",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["aud"] = []string{testClientID, "other"} },
+			wantErr: true,
+		},
+		{
+			name:    "wrong authorized party",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["aud"] = []string{testClientID, "other"}; c["azp"] = "other" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong nonce",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["nonce"] = "another-nonce" },
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["exp"] = time.Now().Add(-2 * clockSkew).Unix() },
+			wantErr: true,
+		},
+		{
+			name:   "expired within clock skew",
+			key:    rsaKey,
+			claims: func(c map[string]any) { c["exp"] = time.Now().Add(-clockSkew / 2).Unix() },
+		},
+		{
+			name:    "issued in the future",
+			key:     rsaKey,
+			claims:  func(c map[string]any) { c["iat"] = time.Now().Add(2 * clockSkew).Unix() },
+			wantErr: true,
+		},
+		{
+			name:    "missing subject",
+			key:     ecKey,
+			claims:  func(c map[string]any) { delete(c, "sub") },
+			wantErr: true,
+		},
+		{
+			name:    "alg doesn't match RSA key",
+			key:     rsaKey,
+			alg:     "ES256",
+			wantErr: true,
+		},
+		{
+			name:    "alg doesn't match EC key",
+			key:     ecKey,
+			alg:     "RS256",
+			wantErr: true,
+		},
+		{
+			name:    "alg none",
+			key:     rsaKey,
+			alg:     "none",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := provider.discover(t)
+
+			claims := provider.claims()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+
+			token := tt.key.sign(t, claims, tt.alg)
+
+			got, err := verifier.VerifyIDToken(context.Background(), token, testNonce)
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("got error %v, want ErrInvalidIDToken", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Subject != "user-1" || got.Email != "alice@example.com" || !got.EmailVerified {
+				t.Errorf("got claims %+v", got)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenTampered(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	provider := newMockProvider(t, key)
+	verifier := provider.discover(t)
+
+	token := key.sign(t, provider.claims(), "")
+	parts := strings.Split(token, ".")
+
+	claims := provider.claims()
+	claims["sub"] = "admin"
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+	_, err := verifier.VerifyIDToken(context.Background(), strings.Join(parts, "."), testNonce)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got error %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestVerifyIDTokenKeyRotation(t *testing.T) {
+	oldKey := newRSAKey(t, "old")
+	newKey := newECKey(t, "new")
+
+	provider := newMockProvider(t, oldKey)
+	verifier := provider.discover(t)
+
+	if _, err := verifier.VerifyIDToken(context.Background(), oldKey.sign(t, provider.claims(), ""), testNonce); err != nil {
+		t.Fatalf("verifying with the old key: %v", err)
+	}
+
+	provider.mu.Lock()
+	provider.keys = []signingKey{oldKey, newKey}
+	provider.mu.Unlock()
+
+	// The keys were fetched less than a minute ago, so an unknown key is refused without
+	// asking the provider again.
+	_, err := verifier.VerifyIDToken(context.Background(), newKey.sign(t, provider.claims(), ""), testNonce)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got error %v, want ErrInvalidIDToken", err)
+	}
+	if got := provider.fetches(); got != 1 {
+		t.Fatalf("got %d key fetches, want 1", got)
+	}
+
+	verifier.mu.Lock()
+	verifier.keysFetchedAt = time.Now().Add(-2 * time.Minute)
+	verifier.mu.Unlock()
+
+	if _, err := verifier.VerifyIDToken(context.Background(), newKey.sign(t, provider.claims(), ""), testNonce); err != nil {
+		t.Fatalf("verifying with the new key: %v", err)
+	}
+	if got := provider.fetches(); got != 2 {
+		t.Fatalf("got %d key fetches, want 2", got)
+	}
+
+	// The known key is found without fetching again.
+	if _, err := verifier.VerifyIDToken(context.Background(), oldKey.sign(t, provider.claims(), ""), testNonce); err != nil {
+		t.Fatalf("verifying with the old key after rotation: %v", err)
+	}
+	if got := provider.fetches(); got != 2 {
+		t.Fatalf("got %d key fetches, want 2", got)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	provider := newMockProvider(t, key)
+	verifier := provider.discover(t)
+
+	provider.idToken = key.sign(t, provider.claims(), "")
+
+	codeVerifier, challenge, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := url.Parse(verifier.AuthCodeURL("the-state", testNonce, challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := authURL.Query()
+	sum := sha256.Sum256([]byte(codeVerifier))
+
+	if got, want := params.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("got code_challenge %q, want %q", got, want)
+	}
+	if got := params.Get("code_challenge_method"); got != "S256" {
+		t.Errorf("got code_challenge_method %q, want S256", got)
+	}
+	if got := params.Get("state"); got != "the-state" {
+		t.Errorf("got state %q, want the-state", got)
+	}
+
+	claims, err := verifier.Exchange(context.Background(), "the-code", codeVerifier, testNonce)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("got subject %q, want user-1", claims.Subject)
+	}
+
+	provider.mu.Lock()
+	form := provider.tokenForm
+	provider.mu.Unlock()
+	if got := form.Get("code_verifier"); got != codeVerifier {
+		t.Errorf("got code_verifier %q, want %q", got, codeVerifier)
+	}
+	if got := form.Get("grant_type"); got != "authorization_code" {
+		t.Errorf("got grant_type %q, want authorization_code", got)
+	}
+	if got := form.Get("redirect_uri"); got != testRedirectURL {
+		t.Errorf("got redirect_uri %q, want %q", got, testRedirectURL)
+	}
+
+	if _, err := verifier.Exchange(context.Background(), "wrong-code", codeVerifier, testNonce); !errors.Is(err, ErrExchange) {
+		t.Errorf("got error %v for a wrong code, want ErrExchange", err)
+	}
+}
@@ -0,0 +1,123 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id hashes passwords with argon2id (RFC 9106), encoded as PHC strings such as
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>.
+type Argon2id struct {
+	Memory      uint32 // In KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PHC strings use standard base64 without padding.
+var phcEncoding = base64.RawStdEncoding
+
+func (a Argon2id) Hash(plaintext string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func decodeArgon2id(encoded string) (*argon2idHash, error) {
+	id, version, params, salt, key, ok := parsePHC(encoded)
+	if !ok || id != "argon2id" {
+		return nil, fmt.Errorf("passhash: malformed argon2id hash")
+	}
+
+	if version != strconv.Itoa(argon2.Version) {
+		return nil, fmt.Errorf("passhash: unsupported argon2 version %q", version)
+	}
+
+	memory, err := strconv.ParseUint(params["m"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("passhash: malformed argon2id memory parameter")
+	}
+
+	iterations, err := strconv.ParseUint(params["t"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("passhash: malformed argon2id iterations parameter")
+	}
+
+	parallelism, err := strconv.ParseUint(params["p"], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("passhash: malformed argon2id parallelism parameter")
+	}
+
+	h := &argon2idHash{
+		memory:      uint32(memory),
+		iterations:  uint32(iterations),
+		parallelism: uint8(parallelism),
+	}
+
+	if h.salt, err = phcEncoding.DecodeString(salt); err != nil {
+		return nil, fmt.Errorf("passhash: malformed argon2id salt")
+	}
+
+	if h.key, err = phcEncoding.DecodeString(key); err != nil {
+		return nil, fmt.Errorf("passhash: malformed argon2id key")
+	}
+
+	return h, nil
+}
+
+func (a Argon2id) Verify(plaintext, encoded string) (bool, error) {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	// Hash with the parameters stored in the hash rather than the configured ones, so that
+	// hashes made before the configuration changed still verify.
+	key := argon2.IDKey([]byte(plaintext), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+func (a Argon2id) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a Argon2id) Outdated(encoded string) bool {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return h.memory != a.Memory ||
+		h.iterations != a.Iterations ||
+		h.parallelism != a.Parallelism ||
+		uint32(len(h.salt)) != a.SaltLength ||
+		uint32(len(h.key)) != a.KeyLength
+}
+
+// Argon2id has no practical limit, but passwords are capped to keep request sizes sensible.
+func (a Argon2id) MaxPasswordLength() int {
+	return 256
+}
@@ -0,0 +1,57 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes passwords with bcrypt. Its hashes are in modular crypt format, such as
+// $2a$12$<salt and hash>, which is self-describing in the same way as a PHC string.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), b.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (b Bcrypt) Verify(plaintext, encoded string) (bool, error) {
+	// Re-hashes the plaintext with the salt and cost from the hash, and compares the two in
+	// constant time.
+	if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plaintext)); err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (b Bcrypt) Identifies(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+// Bcrypt ignores everything after the first 72 bytes of a password.
+func (b Bcrypt) MaxPasswordLength() int {
+	return 72
+}
@@ -0,0 +1,93 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrUnknownAlgorithm = errors.New("passhash: hash was produced by an unknown algorithm")
+
+// Algorithm is a password hashing algorithm whose hashes are self-describing strings, so
+// that the algorithm and parameters a hash was produced with can be read back from it.
+type Algorithm interface {
+	Hash(plaintext string) (string, error)
+	// Verify reports whether plaintext matches encoded. encoded must be a hash this
+	// algorithm Identifies.
+	Verify(plaintext, encoded string) (bool, error)
+	Identifies(encoded string) bool
+	// Outdated reports whether encoded was produced with different parameters from the ones
+	// the algorithm is configured with.
+	Outdated(encoded string) bool
+	// MaxPasswordLength is the longest password in bytes the algorithm fully takes into account.
+	MaxPasswordLength() int
+}
+
+// Hasher hashes new passwords with its preferred algorithm, and verifies hashes produced
+// by any of the algorithms it knows about.
+type Hasher struct {
+	preferred Algorithm
+	known     []Algorithm
+}
+
+func New(preferred Algorithm, others ...Algorithm) *Hasher {
+	return &Hasher{
+		preferred: preferred,
+		known:     append([]Algorithm{preferred}, others...),
+	}
+}
+
+func (h *Hasher) Hash(plaintext string) (string, error) {
+	return h.preferred.Hash(plaintext)
+}
+
+func (h *Hasher) Verify(plaintext, encoded string) (bool, error) {
+	for _, algorithm := range h.known {
+		if algorithm.Identifies(encoded) {
+			return algorithm.Verify(plaintext, encoded)
+		}
+	}
+
+	return false, ErrUnknownAlgorithm
+}
+
+// NeedsRehash reports whether encoded should be replaced by a new hash of the same password,
+// because it wasn't produced by the preferred algorithm with its current parameters.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	return !h.preferred.Identifies(encoded) || h.preferred.Outdated(encoded)
+}
+
+func (h *Hasher) MaxPasswordLength() int {
+	return h.preferred.MaxPasswordLength()
+}
+
+// parsePHC splits a PHC string ($id$param=value,...$salt$hash, with an optional v=
+// section) into its parts. See https://github.com/P-H-C/phc-string-format.
+func parsePHC(encoded string) (id string, version string, params map[string]string, salt, hash string, ok bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 5 || parts[0] != "" {
+		return "", "", nil, "", "", false
+	}
+
+	id = parts[1]
+	rest := parts[2:]
+
+	if strings.HasPrefix(rest[0], "v=") {
+		version = strings.TrimPrefix(rest[0], "v=")
+		rest = rest[1:]
+	}
+
+	if len(rest) != 3 {
+		return "", "", nil, "", "", false
+	}
+
+	params = make(map[string]string)
+	for _, pair := range strings.Split(rest[0], ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return "", "", nil, "", "", false
+		}
+		params[key] = value
+	}
+
+	return id, version, params, rest[1], rest[2], true
+}
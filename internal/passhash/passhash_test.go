@@ -0,0 +1,201 @@
+package passhash
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so that the tests don't spend their time hashing.
+var (
+	testArgon2id = Argon2id{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+)
+
+func TestParsePHC(t *testing.T) {
+	tests := []struct {
+		name        string
+		encoded     string
+		wantID      string
+		wantVersion string
+		wantParams  map[string]string
+		wantSalt    string
+		wantHash    string
+		ok          bool
+	}{
+		{
+			name:        "with version",
+			encoded:     "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA",
+			wantID:      "argon2id",
+			wantVersion: "19",
+			wantParams:  map[string]string{"m": "19456", "t": "2", "p": "1"},
+			wantSalt:    "c2FsdA",
+			wantHash:    "aGFzaA",
+			ok:          true,
+		},
+		{
+			name:       "without version",
+			encoded:    "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA",
+			wantID:     "scrypt",
+			wantParams: map[string]string{"ln": "15", "r": "8", "p": "1"},
+			wantSalt:   "c2FsdA",
+			wantHash:   "aGFzaA",
+			ok:         true,
+		},
+		{name: "no leading $", encoded: "argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA"},
+		{name: "missing hash", encoded: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA"},
+		{name: "extra section", encoded: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA$more"},
+		{name: "param without value", encoded: "$argon2id$v=19$m=19456,t,p=1$c2FsdA$aGFzaA"},
+		{name: "bcrypt", encoded: "$2a$04$abcdefghijklmnopqrstuu"},
+		{name: "empty", encoded: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, version, params, salt, hash, ok := parsePHC(tt.encoded)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t, want %t", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			if id != tt.wantID || version != tt.wantVersion || salt != tt.wantSalt || hash != tt.wantHash {
+				t.Errorf("got %q, %q, %q, %q", id, version, salt, hash)
+			}
+			if len(params) != len(tt.wantParams) {
+				t.Fatalf("got params %v, want %v", params, tt.wantParams)
+			}
+			for key, value := range tt.wantParams {
+				if params[key] != value {
+					t.Errorf("got params %v, want %v", params, tt.wantParams)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2idRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "other algorithm", encoded: "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA"},
+		{name: "other version", encoded: "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA"},
+		{name: "missing memory", encoded: "$argon2id$v=19$t=1,p=1$c2FsdA$aGFzaA"},
+		{name: "memory too large", encoded: "$argon2id$v=19$m=4294967296,t=1,p=1$c2FsdA$aGFzaA"},
+		{name: "parallelism too large", encoded: "$argon2id$v=19$m=64,t=1,p=256$c2FsdA$aGFzaA"},
+		{name: "salt not base64", encoded: "$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaA"},
+		{name: "hash padded", encoded: "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA=="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeArgon2id(tt.encoded); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestHasherVerify(t *testing.T) {
+	hasher := New(testArgon2id, testBcrypt)
+
+	argon2idHash, err := testArgon2id.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashes made before argon2id was preferred are still verified with bcrypt.
+	bcryptHash, err := testBcrypt.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		plaintext string
+		encoded   string
+		want      bool
+		wantErr   error
+	}{
+		{name: "argon2id match", plaintext: "pa55word", encoded: argon2idHash, want: true},
+		{name: "argon2id mismatch", plaintext: "pa55word!", encoded: argon2idHash},
+		{name: "bcrypt match", plaintext: "pa55word", encoded: bcryptHash, want: true},
+		{name: "bcrypt mismatch", plaintext: "pa55word!", encoded: bcryptHash},
+		{name: "unknown algorithm", plaintext: "pa55word", encoded: "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA", wantErr: ErrUnknownAlgorithm},
+		{name: "plaintext", plaintext: "pa55word", encoded: "pa55word", wantErr: ErrUnknownAlgorithm},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasher.Verify(tt.plaintext, tt.encoded)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	hasher := New(testArgon2id, testBcrypt)
+
+	hash := func(a Algorithm) string {
+		t.Helper()
+
+		encoded, err := a.Hash("pa55word")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	moreMemory := testArgon2id
+	moreMemory.Memory *= 2
+	moreIterations := testArgon2id
+	moreIterations.Iterations++
+	longerSalt := testArgon2id
+	longerSalt.SaltLength *= 2
+	longerKey := testArgon2id
+	longerKey.KeyLength *= 2
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    bool
+	}{
+		{name: "current parameters", encoded: hash(testArgon2id)},
+		{name: "other memory", encoded: hash(moreMemory), want: true},
+		{name: "other iterations", encoded: hash(moreIterations), want: true},
+		{name: "other salt length", encoded: hash(longerSalt), want: true},
+		{name: "other key length", encoded: hash(longerKey), want: true},
+		{name: "bcrypt", encoded: hash(testBcrypt), want: true},
+		{name: "malformed argon2id", encoded: "$argon2id$v=19$m=64$c2FsdA$aGFzaA", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasher.NeedsRehash(tt.encoded); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBcryptOutdated(t *testing.T) {
+	encoded, err := testBcrypt.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testBcrypt.Outdated(encoded) {
+		t.Error("hash with the configured cost is outdated")
+	}
+	if !(Bcrypt{Cost: testBcrypt.Cost + 1}).Outdated(encoded) {
+		t.Error("hash with a lower cost isn't outdated")
+	}
+}
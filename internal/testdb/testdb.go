@@ -0,0 +1,149 @@
+// Package testdb gives tests a PostgreSQL database with every migration applied. The tests
+// that use it are skipped unless GREENLIGHT_TEST_DB_DSN is set to the DSN of a database they
+// may create schemas in.
+package testdb
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// Taken by every test binary while it installs extensions, since two CREATE EXTENSION IF NOT
+// EXISTS running at once can both try to create it.
+const extensionLock = 7_241_903
+
+var extensionPattern = regexp.MustCompile(`(?i)CREATE EXTENSION IF NOT EXISTS (\w+)`)
+
+// New returns a connection pool to a schema of its own, which is dropped when the test ends.
+func New(t testing.TB) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN is not set")
+	}
+
+	migrations := readMigrations(t)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(b)
+
+	ctx := context.Background()
+
+	// Extensions are installed once, in public, rather than in whichever test schema happens
+	// to apply the migrations first, which would take them away from the others when dropped.
+	conn, err := admin.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", extensionLock); err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations {
+		for _, match := range extensionPattern.FindAllStringSubmatch(migration, -1) {
+			if _, err := conn.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS "+match[1]+" SCHEMA public"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", extensionLock); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer admin.Close()
+
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	db, err := sql.Open("postgres", withSearchPath(t, dsn, schema+",public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, migration := range migrations {
+		if _, err := db.ExecContext(ctx, migration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db
+}
+
+// readMigrations returns the up migrations in the order they are applied.
+func readMigrations(t testing.TB) []string {
+	t.Helper()
+
+	_, file, _, _ := runtime.Caller(0)
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(file), "..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(paths)
+
+	var migrations []string
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrations = append(migrations, string(b))
+	}
+
+	return migrations
+}
+
+// withSearchPath adds search_path to dsn, which lib/pq sends as a run-time parameter on every
+// connection in the pool.
+func withSearchPath(t testing.TB, dsn, searchPath string) string {
+	t.Helper()
+
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + searchPath
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	q.Set("search_path", searchPath)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
@@ -0,0 +1,87 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret from the RFC 6238 appendix B test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B gives 8-digit codes; the 6-digit codes are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			if got := Code(rfcSecret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// 1111111109 is step 37037036, a second before 1111111110 starts step 37037037.
+	now := time.Unix(1111111109, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		valid    bool
+	}{
+		{name: "current step", code: Code(rfcSecret, current), wantStep: current, valid: true},
+		{name: "previous step", code: Code(rfcSecret, current-1), wantStep: current - 1, valid: true},
+		{name: "next step", code: Code(rfcSecret, current+1), wantStep: current + 1, valid: true},
+		{name: "two steps ago", code: Code(rfcSecret, current-2)},
+		{name: "two steps ahead", code: Code(rfcSecret, current+2)},
+		{name: "wrong code", code: "000000"},
+		{name: "too short", code: Code(rfcSecret, current)[:5]},
+		{name: "too long", code: Code(rfcSecret, current) + "0"},
+		{name: "empty", code: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, valid := Validate(rfcSecret, tt.code, now)
+			if valid != tt.valid {
+				t.Fatalf("got valid %t, want %t", valid, tt.valid)
+			}
+			if valid && step != tt.wantStep {
+				t.Errorf("got step %d, want %d", step, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Greenlight", "alice@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Greenlight:alice@example.com" {
+		t.Errorf("got %s", u)
+	}
+
+	q := u.Query()
+	if q.Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("got secret %q", q.Get("secret"))
+	}
+	if q.Get("issuer") != "Greenlight" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("got query %v", q)
+	}
+}
@@ -1,8 +1,10 @@
 package validator
 
 import (
+	"math"
 	"regexp"
 	"slices"
+	"unicode"
 )
 
 var (
@@ -55,3 +57,55 @@ func Unique[T comparable](values []T) bool {
 
 	return len(uniqueValues) == len(values)
 }
+
+// Estimated entropy of a password in bits. Each character is worth log2 of the size of the
+// character classes the password uses, except that a character repeating or continuing a
+// sequence from the one before it (e.g. "aaa" or "123") is only worth one bit.
+func Entropy(value string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	bitsPerChar := math.Log2(float64(pool))
+
+	var (
+		bits float64
+		prev rune = -1
+	)
+	for _, r := range value {
+		if prev >= 0 && (r == prev || r == prev+1 || r == prev-1) {
+			bits++
+		} else {
+			bits += bitsPerChar
+		}
+		prev = r
+	}
+
+	return bits
+}
@@ -0,0 +1,6 @@
+-- Tokens issued from the same login share a family, so that reuse of a rotated refresh
+-- token can revoke everything that descended from it.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS locked_until;
+
+DROP TABLE IF EXISTS login_failures;
\ No newline at end of file
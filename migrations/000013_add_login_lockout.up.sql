@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email citext NOT NULL,
+    ip text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_email_idx ON login_failures (email, created_at);
+CREATE INDEX IF NOT EXISTS login_failures_ip_idx ON login_failures (ip, created_at);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
\ No newline at end of file
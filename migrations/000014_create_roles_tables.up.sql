@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS permissions_code_idx ON permissions (code);
+
+-- Wildcard codes: "movies:*" covers every movies permission and "*" covers everything.
+INSERT INTO permissions (code) VALUES ('movies:*'), ('*') ON CONFLICT DO NOTHING;
+
+INSERT INTO roles (name, description) VALUES
+    ('viewer', 'Can read movies'),
+    ('editor', 'Can read and write movies'),
+    ('admin', 'Has every permission')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+   OR (roles.name = 'editor' AND permissions.code = 'movies:*')
+   OR (roles.name = 'admin' AND permissions.code = '*')
+ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1 @@
+INSERT INTO permissions (code) VALUES ('users:admin') ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+-- Lets a user change or delete only the movies they created, unlike movies:write.
+INSERT INTO permissions (code) VALUES ('movies:write:own') ON CONFLICT DO NOTHING;
\ No newline at end of file
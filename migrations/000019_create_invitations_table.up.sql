@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    created_by bigint REFERENCES users ON DELETE SET NULL,
+    -- The invitation can only be redeemed by registering with this address
+    email citext NOT NULL,
+    hash bytea UNIQUE NOT NULL,
+    -- Granted directly to the user when they register
+    permissions text[] NOT NULL DEFAULT '{}',
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations (email);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS movies_title_search_idx;
\ No newline at end of file